@@ -0,0 +1,38 @@
+-- Job leases: a worker claims a job atomically and holds it until lease_expires_at
+alter table jobs
+add column if not exists locked_by text,
+add column if not exists lease_expires_at timestamptz;
+
+create index if not exists jobs_queued_created_at_idx
+on jobs (created_at)
+where status = 'queued';
+
+-- Claim the oldest queued job for a worker in one round-trip.
+-- FOR UPDATE SKIP LOCKED lets several replicas poll at once without
+-- fighting over the same row: each caller gets a different job or none.
+create or replace function claim_job(
+  p_worker_id text,
+  p_lease_seconds int default 300
+) returns setof jobs
+language sql security definer as $$
+  with next_job as (
+    select id
+    from jobs
+    where status = 'queued'
+    order by created_at asc
+    limit 1
+    for update skip locked
+  )
+  update jobs j
+  set
+    status = 'processing',
+    locked_by = p_worker_id,
+    lease_expires_at = now() + make_interval(secs => p_lease_seconds),
+    updated_at = now()
+  from next_job
+  where j.id = next_job.id
+  returning j.*;
+$$;
+
+-- Only the service role (the worker) may claim jobs
+revoke execute on function claim_job(text, int) from public, anon, authenticated;
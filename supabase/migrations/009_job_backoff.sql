@@ -0,0 +1,38 @@
+-- Scheduled retries: a failed job is re-queued with a next_attempt_at in the
+-- future (exponential backoff) and is not claimable until then
+alter table jobs
+add column if not exists next_attempt_at timestamptz;
+
+drop index if exists jobs_queued_created_at_idx;
+create index if not exists jobs_queued_due_idx
+on jobs (next_attempt_at, created_at)
+where status = 'queued';
+
+-- Same as 007, but skip jobs that are still backing off
+create or replace function claim_job(
+  p_worker_id text,
+  p_lease_seconds int default 300
+) returns setof jobs
+language sql security definer as $$
+  with next_job as (
+    select id
+    from jobs
+    where status = 'queued'
+      and (next_attempt_at is null or next_attempt_at <= now())
+    order by created_at asc
+    limit 1
+    for update skip locked
+  )
+  update jobs j
+  set
+    status = 'processing',
+    locked_by = p_worker_id,
+    lease_expires_at = now() + make_interval(secs => p_lease_seconds),
+    next_attempt_at = null,
+    updated_at = now()
+  from next_job
+  where j.id = next_job.id
+  returning j.*;
+$$;
+
+revoke execute on function claim_job(text, int) from public, anon, authenticated;
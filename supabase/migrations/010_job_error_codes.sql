@@ -0,0 +1,73 @@
+-- Structured failure reasons. error_code holds the worker's reason code
+-- (invalid_pdf, file_not_found, gemini_quota, ...); error_kind says whether
+-- it was permanent (dead-lettered straight to failed), transient or rate_limited.
+alter table jobs
+add column if not exists error_code text,
+add column if not exists error_kind text check (error_kind in ('permanent', 'transient', 'rate_limited'));
+
+create index if not exists jobs_error_code_idx
+on jobs (error_code)
+where error_code is not null;
+
+-- Dead letters: jobs that will not be retried, with the reason they stopped
+create or replace view failed_jobs as
+select
+  j.id,
+  j.document_id,
+  d.name as document_name,
+  j.user_id,
+  j.error_code,
+  j.error_kind,
+  j.last_error,
+  j.attempts,
+  j.updated_at as failed_at
+from jobs j
+join documents d on d.id = j.document_id
+where j.status = 'failed';
+
+revoke all on failed_jobs from anon, authenticated;
+
+-- Same as 008, but record a reason code on reaped jobs
+create or replace function reap_expired_jobs(
+  p_max_attempts int default 3
+) returns setof jobs
+language plpgsql security definer as $$
+begin
+  if not pg_try_advisory_xact_lock(hashtext('reap_expired_jobs')) then
+    return;
+  end if;
+
+  return query
+  with expired as (
+    select id
+    from jobs
+    where status = 'processing'
+      and lease_expires_at < now()
+    for update skip locked
+  ),
+  reaped as (
+    update jobs j
+    set
+      status = case when j.attempts < p_max_attempts then 'queued' else 'failed' end,
+      attempts = case when j.attempts < p_max_attempts then j.attempts + 1 else j.attempts end,
+      last_error = 'lease expired (worker ' || coalesce(j.locked_by, 'unknown') || ' stopped heartbeating)',
+      error_code = 'lease_expired',
+      error_kind = 'transient',
+      locked_by = null,
+      lease_expires_at = null,
+      updated_at = now()
+    from expired
+    where j.id = expired.id
+    returning j.*
+  ),
+  failed_docs as (
+    update documents d
+    set status = 'error', updated_at = now()
+    from reaped
+    where reaped.status = 'failed' and d.id = reaped.document_id
+  )
+  select * from reaped;
+end;
+$$;
+
+revoke execute on function reap_expired_jobs(int) from public, anon, authenticated;
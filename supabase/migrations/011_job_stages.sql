@@ -0,0 +1,41 @@
+-- Pipeline stage tracking. jobs.stage says where a job is right now
+-- (downloading, extracting, ocr, chunking, embedding, persisting, finalizing),
+-- stage_page which page it is on, and stage_started_at since when.
+alter table jobs
+add column if not exists stage_page integer,
+add column if not exists stage_started_at timestamptz;
+
+-- Time spent per stage for each run (attempt) of a job. Page stages repeat
+-- once per page, so duration_ms is the sum over all pages and entries the count.
+create table if not exists job_stage_timings (
+  id uuid primary key default gen_random_uuid(),
+  job_id uuid not null references jobs(id) on delete cascade,
+  document_id uuid not null references documents(id) on delete cascade,
+  attempt integer not null default 0,
+  stage text not null,
+  started_at timestamptz not null,
+  finished_at timestamptz not null,
+  duration_ms bigint not null,
+  entries integer not null default 1,
+  created_at timestamptz default now()
+);
+
+create index if not exists job_stage_timings_job_id_idx on job_stage_timings(job_id);
+create index if not exists job_stage_timings_stage_idx on job_stage_timings(stage, created_at desc);
+
+-- Worker-only table: no policies, so only the service role can read or write it
+alter table job_stage_timings enable row level security;
+
+-- How long each stage takes across the corpus
+create or replace view stage_duration_stats as
+select
+  stage,
+  count(distinct job_id) as jobs,
+  sum(entries) as entries,
+  avg(duration_ms)::bigint as avg_job_ms,
+  percentile_cont(0.95) within group (order by duration_ms)::bigint as p95_job_ms,
+  (sum(duration_ms) / nullif(sum(entries), 0))::bigint as avg_entry_ms
+from job_stage_timings
+group by stage;
+
+revoke all on stage_duration_stats from anon, authenticated;
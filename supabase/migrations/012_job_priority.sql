@@ -0,0 +1,91 @@
+-- Job priorities and per-user fair scheduling.
+-- priority: higher runs first (0 = normal uploads, 100 = urgent admin re-runs).
+alter table jobs
+add column if not exists priority integer not null default 0;
+
+drop index if exists jobs_queued_due_idx;
+create index if not exists jobs_queued_due_idx
+on jobs (priority desc, next_attempt_at, created_at)
+where status = 'queued';
+
+create index if not exists jobs_processing_user_idx
+on jobs (user_id)
+where status = 'processing';
+
+-- Claim the next job fairly:
+--   1. highest priority first, so urgent jobs jump the queue;
+--   2. then the user with the fewest jobs already processing;
+--   3. then round-robin: every user's oldest job before anyone's second;
+--   4. then oldest first.
+-- Ranking needs window functions, which can't be combined with FOR UPDATE,
+-- so we rank a short candidate list and lock the first one nobody else holds.
+create or replace function claim_job(
+  p_worker_id text,
+  p_lease_seconds int default 300
+) returns setof jobs
+language plpgsql security definer as $$
+declare
+  candidate uuid;
+  claimed_id uuid;
+begin
+  for candidate in
+    with running as (
+      select user_id, count(*) as n
+      from jobs
+      where status = 'processing'
+      group by user_id
+    ),
+    queued as (
+      select
+        j.id,
+        j.user_id,
+        j.priority,
+        j.created_at,
+        row_number() over (partition by j.user_id order by j.priority desc, j.created_at asc) as user_rank
+      from jobs j
+      where j.status = 'queued'
+        and (j.next_attempt_at is null or j.next_attempt_at <= now())
+    )
+    select q.id
+    from queued q
+    left join running r on r.user_id = q.user_id
+    order by q.priority desc, coalesce(r.n, 0) asc, q.user_rank asc, q.created_at asc
+    limit 20
+  loop
+    select id into claimed_id
+    from jobs
+    where id = candidate and status = 'queued'
+    for update skip locked;
+
+    if found then
+      return query
+      update jobs
+      set
+        status = 'processing',
+        locked_by = p_worker_id,
+        lease_expires_at = now() + make_interval(secs => p_lease_seconds),
+        next_attempt_at = null,
+        updated_at = now()
+      where id = claimed_id
+      returning *;
+      return;
+    end if;
+  end loop;
+end;
+$$;
+
+revoke execute on function claim_job(text, int) from public, anon, authenticated;
+
+-- Let an admin push a document's pending job to the front of the queue
+create or replace function prioritize_document_jobs(
+  p_document_id uuid,
+  p_priority int default 100
+) returns setof jobs
+language sql security definer as $$
+  update jobs
+  set priority = p_priority, next_attempt_at = null, updated_at = now()
+  where document_id = p_document_id and status = 'queued'
+  returning *;
+$$;
+
+revoke execute on function prioritize_document_jobs(uuid, int) from public, anon, authenticated;
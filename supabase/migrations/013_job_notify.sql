@@ -0,0 +1,17 @@
+-- Wake idle workers as soon as a job becomes claimable instead of waiting
+-- for their next poll. Workers LISTEN on 'job_queued' over a direct
+-- database connection (DATABASE_URL); the payload is the job id.
+create or replace function notify_job_queued()
+returns trigger as $$
+begin
+  perform pg_notify('job_queued', new.id::text);
+  return new;
+end;
+$$ language plpgsql;
+
+drop trigger if exists notify_job_queued_trigger on jobs;
+create trigger notify_job_queued_trigger
+  after insert or update of status on jobs
+  for each row
+  when (new.status = 'queued')
+  execute function notify_job_queued();
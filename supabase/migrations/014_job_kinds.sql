@@ -0,0 +1,26 @@
+-- Typed jobs. kind picks what the worker does to the document; params holds
+-- kind-specific options, e.g. {"pages": [3, 7]} for reocr or
+-- {"only_missing": true} for reembed.
+alter table jobs
+add column if not exists kind text not null default 'ingest'
+  check (kind in ('ingest', 'rechunk', 'reembed', 'reocr', 'purge')),
+add column if not exists params jsonb not null default '{}'::jsonb;
+
+-- Queue a job for an existing document, e.g. from the SQL editor:
+--   select * from enqueue_job('<document id>', 'reocr', '{"pages": [12]}', 100);
+-- Replaces one-off programs such as worker/reset_all.go.
+create or replace function enqueue_job(
+  p_document_id uuid,
+  p_kind text default 'ingest',
+  p_params jsonb default '{}'::jsonb,
+  p_priority int default 0
+) returns setof jobs
+language sql security definer as $$
+  insert into jobs (document_id, user_id, status, stage, attempts, kind, params, priority)
+  select d.id, d.user_id, 'queued', 'init', 0, p_kind, p_params, p_priority
+  from documents d
+  where d.id = p_document_id
+  returning *;
+$$;
+
+revoke execute on function enqueue_job(uuid, text, jsonb, int) from public, anon, authenticated;
@@ -0,0 +1,29 @@
+-- Cooperative cancellation. Setting cancel_requested stops a running job
+-- within a few seconds (the worker polls it between heartbeats); the job
+-- ends as 'cancelled', which is not counted as a failed attempt.
+-- Deleting a document cascades to its jobs, and the worker treats the
+-- vanished row the same way.
+alter table jobs
+add column if not exists cancel_requested boolean not null default false;
+
+alter table jobs drop constraint if exists jobs_status_check;
+alter table jobs add constraint jobs_status_check
+  check (status in ('queued', 'processing', 'completed', 'failed', 'cancelled'));
+
+-- Cancel every pending or running job for a document. Queued jobs are
+-- cancelled outright; processing ones are flagged for their worker.
+create or replace function cancel_document_jobs(
+  p_document_id uuid
+) returns setof jobs
+language sql security definer as $$
+  update jobs
+  set
+    cancel_requested = true,
+    status = case when status = 'queued' then 'cancelled' else status end,
+    updated_at = now()
+  where document_id = p_document_id
+    and status in ('queued', 'processing')
+  returning *;
+$$;
+
+revoke execute on function cancel_document_jobs(uuid) from public, anon, authenticated;
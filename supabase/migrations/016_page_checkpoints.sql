@@ -0,0 +1,46 @@
+-- Per-page checkpoints, so a retried job resumes where it failed instead of
+-- re-extracting, re-OCRing and re-embedding every page before it.
+-- A page is complete once its text and all of its chunks (with embeddings)
+-- are stored; the worker writes these columns last. Checkpoints belong to
+-- the job that wrote them: only a retry of that job may skip the page, so a
+-- new ingest of the same document (a replaced file, changed OCR settings)
+-- processes every page again.
+--   text_hash:   sha256 (hex) of document_pages.text as the worker saved it
+--   method:      how the text was obtained (text_layer, ocr, docx, ...)
+--   chunk_count: how many chunks the page was split into
+--   job_id:      the job that completed the page
+alter table document_pages
+add column if not exists text_hash text,
+add column if not exists method text,
+add column if not exists chunk_count integer,
+add column if not exists completed_at timestamptz,
+add column if not exists job_id uuid references jobs(id) on delete set null;
+
+create index if not exists document_chunks_document_page_idx
+on document_chunks (document_id, page_number);
+
+-- Pages of a document that job p_job_id completed and that are still
+-- consistent: the text hasn't changed since it was chunked and every chunk
+-- has its embedding. Anything else is reprocessed on retry.
+create or replace function completed_pages(
+  p_document_id uuid,
+  p_job_id uuid
+) returns table (page_number integer, method text, chunk_count integer)
+language sql stable security definer as $$
+  select p.page_number, p.method, p.chunk_count
+  from document_pages p
+  where p.document_id = p_document_id
+    and p.completed_at is not null
+    and p.job_id = p_job_id
+    and p.text_hash = encode(sha256(convert_to(coalesce(p.text, ''), 'UTF8')), 'hex')
+    and p.chunk_count = (
+      select count(*)
+      from document_chunks c
+      where c.document_id = p.document_id
+        and c.page_number = p.page_number
+        and c.embedding is not null
+    )
+  order by p.page_number;
+$$;
+
+revoke execute on function completed_pages(uuid, uuid) from public, anon, authenticated;
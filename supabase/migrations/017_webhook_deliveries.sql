@@ -0,0 +1,57 @@
+-- Outgoing webhooks for document ingestion events (document.processing,
+-- document.ready, document.failed). The worker writes one row per event and
+-- endpoint, then delivers it; failed deliveries are retried with backoff
+-- until max attempts, so this table doubles as the delivery log.
+create table if not exists webhook_deliveries (
+  id uuid primary key default gen_random_uuid(),
+  event_id uuid not null,
+  event_type text not null,
+  -- No foreign key: the log outlives deleted documents
+  document_id uuid,
+  endpoint text not null,
+  payload jsonb not null,
+  status text not null default 'pending' check (status in ('pending', 'delivered', 'failed')),
+  attempts integer not null default 0,
+  next_attempt_at timestamptz not null default now(),
+  last_status_code integer,
+  last_error text,
+  created_at timestamptz not null default now(),
+  delivered_at timestamptz
+);
+
+create index if not exists webhook_deliveries_due_idx
+on webhook_deliveries (next_attempt_at)
+where status = 'pending';
+
+create index if not exists webhook_deliveries_document_idx
+on webhook_deliveries (document_id, created_at desc);
+
+-- Service role only
+alter table webhook_deliveries enable row level security;
+
+-- Take up to p_limit due deliveries for sending. Pushing next_attempt_at out
+-- by the lease keeps other workers off them while the request is in flight;
+-- a worker that dies mid-send just lets the lease run out.
+create or replace function claim_webhook_deliveries(
+  p_limit int default 20,
+  p_lease_seconds int default 60
+) returns setof webhook_deliveries
+language sql security definer as $$
+  update webhook_deliveries d
+  set
+    attempts = d.attempts + 1,
+    next_attempt_at = now() + make_interval(secs => p_lease_seconds)
+  from (
+    select id
+    from webhook_deliveries
+    where status = 'pending'
+      and next_attempt_at <= now()
+    order by next_attempt_at
+    limit p_limit
+    for update skip locked
+  ) due
+  where d.id = due.id
+  returning d.*;
+$$;
+
+revoke execute on function claim_webhook_deliveries(int, int) from public, anon, authenticated;
@@ -0,0 +1,125 @@
+-- Recurring maintenance run by the worker: re-embedding chunks stored
+-- without an embedding, rebuilding the ivfflat index and sweeping Storage
+-- objects no document points to. Replaces one-off programs such as
+-- worker/check_embeddings.go and scripts/reprocess_broken_docs.js.
+
+-- Leader lease: every replica runs the scheduler, but only the holder of
+-- this single row runs tasks. A replica that stops renewing loses it once
+-- lease_expires_at passes.
+create table if not exists maintenance_leader (
+  id boolean primary key default true check (id),
+  holder text not null,
+  lease_expires_at timestamptz not null
+);
+
+alter table maintenance_leader enable row level security;
+
+-- Take or renew the lease. Returns true if p_worker_id holds it afterwards.
+create or replace function acquire_maintenance_lease(
+  p_worker_id text,
+  p_lease_seconds int default 120
+) returns boolean
+language sql security definer as $$
+  with won as (
+    insert into maintenance_leader as l (id, holder, lease_expires_at)
+    values (true, p_worker_id, now() + make_interval(secs => p_lease_seconds))
+    on conflict (id) do update
+    set
+      holder = excluded.holder,
+      lease_expires_at = excluded.lease_expires_at
+    where l.holder = excluded.holder
+      or l.lease_expires_at < now()
+    returning 1
+  )
+  select exists (select 1 from won);
+$$;
+
+-- Give the lease up on shutdown so another replica takes over at once.
+create or replace function release_maintenance_lease(
+  p_worker_id text
+) returns void
+language sql security definer as $$
+  delete from maintenance_leader where holder = p_worker_id;
+$$;
+
+revoke execute on function acquire_maintenance_lease(text, int) from public, anon, authenticated;
+revoke execute on function release_maintenance_lease(text) from public, anon, authenticated;
+
+-- One row per task: when it runs next and how its last run went. Kept here
+-- rather than in memory so restarts and leader changes don't rerun or skip
+-- anything. A run that never finished stays 'running' with next_run_at in
+-- the past, so the next leader runs it again.
+create table if not exists maintenance_runs (
+  task text primary key,
+  schedule text not null,
+  next_run_at timestamptz not null,
+  last_started_at timestamptz,
+  last_finished_at timestamptz,
+  last_status text check (last_status in ('running', 'succeeded', 'failed')),
+  last_error text,
+  last_result text,
+  last_duration_ms bigint,
+  last_worker text,
+  run_count integer not null default 0,
+  updated_at timestamptz not null default now()
+);
+
+alter table maintenance_runs enable row level security;
+
+-- Queue a low-priority reembed job (only_missing) for ready documents that
+-- have chunks without an embedding, skipping documents that already have a
+-- job queued or running.
+create or replace function enqueue_missing_embeddings(
+  p_limit int default 50,
+  p_priority int default -10
+) returns setof jobs
+language sql security definer as $$
+  insert into jobs (document_id, user_id, status, stage, attempts, kind, params, priority)
+  select d.id, d.user_id, 'queued', 'init', 0, 'reembed', '{"only_missing": true}'::jsonb, p_priority
+  from documents d
+  where d.status = 'ready'
+    and exists (
+      select 1
+      from document_chunks c
+      where c.document_id = d.id
+        and c.embedding is null
+    )
+    and not exists (
+      select 1
+      from jobs j
+      where j.document_id = d.id
+        and j.status in ('queued', 'processing')
+    )
+  limit p_limit
+  returning *;
+$$;
+
+revoke execute on function enqueue_missing_embeddings(int, int) from public, anon, authenticated;
+
+create index if not exists documents_storage_path_idx
+on documents (storage_path);
+
+-- Objects in p_bucket that no document references. Only objects older than
+-- p_min_age_seconds are returned, so uploads whose document row hasn't been
+-- pointed at them yet are left alone. The worker deletes them through the
+-- Storage API, which also removes the underlying files.
+create or replace function orphaned_storage_objects(
+  p_bucket text,
+  p_min_age_seconds int default 86400,
+  p_limit int default 100
+) returns table (name text, created_at timestamptz)
+language sql stable security definer as $$
+  select o.name, o.created_at
+  from storage.objects o
+  where o.bucket_id = p_bucket
+    and o.created_at < now() - make_interval(secs => p_min_age_seconds)
+    and not exists (
+      select 1
+      from documents d
+      where d.storage_path = o.name
+    )
+  order by o.created_at
+  limit p_limit;
+$$;
+
+revoke execute on function orphaned_storage_objects(text, int, int) from public, anon, authenticated;
@@ -0,0 +1,184 @@
+-- Bulk ingestion of a Storage folder. An ingest_folder job lists every
+-- object under params.prefix in the documents bucket and creates a document
+-- and a child ingest job for each file no document points to yet. The
+-- parent has no document of its own; folder_job_progress aggregates its
+-- children.
+--   select * from enqueue_folder('<user id>', 'division-x/manuals/');
+alter table jobs
+alter column document_id drop not null,
+add column if not exists parent_id uuid references jobs(id) on delete set null;
+
+alter table jobs drop constraint if exists jobs_kind_check;
+alter table jobs add constraint jobs_kind_check
+  check (kind in ('ingest', 'rechunk', 'reembed', 'reocr', 'purge', 'ingest_folder'));
+
+alter table jobs drop constraint if exists jobs_document_check;
+alter table jobs add constraint jobs_document_check
+  check (document_id is not null or kind = 'ingest_folder');
+
+create index if not exists jobs_parent_id_idx
+on jobs (parent_id)
+where parent_id is not null;
+
+-- Folder jobs record stage timings too
+alter table job_stage_timings
+alter column document_id drop not null;
+
+-- Queue a folder job. The documents it creates belong to p_user_id.
+create or replace function enqueue_folder(
+  p_user_id uuid,
+  p_prefix text,
+  p_priority int default 0
+) returns setof jobs
+language sql security definer as $$
+  insert into jobs (document_id, user_id, status, stage, attempts, kind, params, priority)
+  values (null, p_user_id, 'queued', 'init', 0, 'ingest_folder', jsonb_build_object('prefix', p_prefix), p_priority)
+  returning *;
+$$;
+
+revoke execute on function enqueue_folder(uuid, text, int) from public, anon, authenticated;
+
+-- One page of object names under p_prefix, after p_after in name order.
+create or replace function list_storage_objects(
+  p_bucket text,
+  p_prefix text,
+  p_after text default '',
+  p_limit int default 500
+) returns table (name text)
+language sql stable security definer as $$
+  select o.name
+  from storage.objects o
+  where o.bucket_id = p_bucket
+    and left(o.name, length(p_prefix)) = p_prefix
+    and o.name > p_after
+  order by o.name
+  limit p_limit;
+$$;
+
+revoke execute on function list_storage_objects(text, text, text, int) from public, anon, authenticated;
+
+-- Create a document and child ingest job for each path no document points
+-- to yet, owned by the parent's user and at the parent's priority. Returns
+-- the child jobs created, so a retried parent skips what it already queued.
+-- The lock keeps two folder jobs over the same files from both creating them.
+create or replace function enqueue_folder_files(
+  p_parent_id uuid,
+  p_paths text[]
+) returns setof jobs
+language sql security definer as $$
+  select pg_advisory_xact_lock(hashtext('enqueue_folder_files'));
+
+  with parent as (
+    select id, user_id, priority
+    from jobs
+    where id = p_parent_id
+  ),
+  new_docs as (
+    insert into documents (user_id, name, storage_path, status, pages_total)
+    select parent.user_id, regexp_replace(path, '^.*/', ''), path, 'processing', 0
+    from parent, unnest(p_paths) as path
+    where not exists (
+      select 1
+      from documents d
+      where d.storage_path = path
+    )
+    returning id, user_id
+  )
+  insert into jobs (document_id, user_id, status, stage, attempts, kind, priority, parent_id)
+  select new_docs.id, new_docs.user_id, 'queued', 'init', 0, 'ingest', parent.priority, parent.id
+  from new_docs, parent
+  returning *;
+$$;
+
+revoke execute on function enqueue_folder_files(uuid, text[]) from public, anon, authenticated;
+
+-- Aggregate progress of each folder job over its child jobs and documents.
+-- state is 'listing' while the parent is still creating children, 'running'
+-- while any child is pending, then 'completed' or 'completed_with_errors';
+-- a parent that failed or was cancelled reports its own status.
+create or replace view folder_job_progress
+with (security_invoker = true) as
+select
+  p.id as job_id,
+  p.user_id,
+  p.params->>'prefix' as prefix,
+  case
+    when p.status in ('queued', 'processing') then 'listing'
+    when p.status <> 'completed' then p.status
+    when count(c.id) filter (where c.status in ('queued', 'processing')) > 0 then 'running'
+    when count(c.id) filter (where c.status in ('failed', 'cancelled')) > 0 then 'completed_with_errors'
+    else 'completed'
+  end as state,
+  count(c.id) as files_total,
+  count(c.id) filter (where c.status = 'queued') as files_queued,
+  count(c.id) filter (where c.status = 'processing') as files_processing,
+  count(c.id) filter (where c.status = 'completed') as files_completed,
+  count(c.id) filter (where c.status = 'failed') as files_failed,
+  count(c.id) filter (where c.status = 'cancelled') as files_cancelled,
+  coalesce(sum(d.pages_total), 0) as pages_total,
+  coalesce(sum(d.pages_done), 0) as pages_done,
+  p.created_at,
+  max(c.updated_at) as updated_at
+from jobs p
+left join jobs c on c.parent_id = p.id
+left join documents d on d.id = c.document_id
+where p.kind = 'ingest_folder'
+group by p.id;
+
+revoke all on folder_job_progress from anon, authenticated;
+
+-- Same as 010, but folder jobs have no document: a left join keeps their
+-- failures (empty_folder, invalid_params) in the dead-letter view. kind
+-- tells them apart.
+create or replace view failed_jobs as
+select
+  j.id,
+  j.document_id,
+  d.name as document_name,
+  j.user_id,
+  j.error_code,
+  j.error_kind,
+  j.last_error,
+  j.attempts,
+  j.updated_at as failed_at,
+  j.kind
+from jobs j
+left join documents d on d.id = j.document_id
+where j.status = 'failed';
+
+revoke all on failed_jobs from anon, authenticated;
+
+-- Folder files are uploaded before any document points to them, so the
+-- orphan sweep (migration 018) would delete a folder still waiting for its
+-- ingest_folder job, e.g. behind a busy queue or in retry backoff. Objects
+-- under the prefix of a queued or processing folder job are left alone.
+-- Files staged without a folder job are still swept once they are older
+-- than p_min_age_seconds (ORPHAN_MIN_AGE), so queue the folder
+-- job within that window.
+create or replace function orphaned_storage_objects(
+  p_bucket text,
+  p_min_age_seconds int default 86400,
+  p_limit int default 100
+) returns table (name text, created_at timestamptz)
+language sql stable security definer as $$
+  select o.name, o.created_at
+  from storage.objects o
+  where o.bucket_id = p_bucket
+    and o.created_at < now() - make_interval(secs => p_min_age_seconds)
+    and not exists (
+      select 1
+      from documents d
+      where d.storage_path = o.name
+    )
+    and not exists (
+      select 1
+      from jobs j
+      where j.kind = 'ingest_folder'
+        and j.status in ('queued', 'processing')
+        and left(o.name, length(j.params->>'prefix')) = j.params->>'prefix'
+    )
+  order by o.created_at
+  limit p_limit;
+$$;
+
+revoke execute on function orphaned_storage_objects(text, int, int) from public, anon, authenticated;
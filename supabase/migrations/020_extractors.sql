@@ -0,0 +1,9 @@
+-- Files are parsed by an extractor chosen from their content (magic bytes)
+-- rather than their extension. mime_type records what was detected;
+-- document_pages.metadata holds what the extractor knows about each page,
+-- e.g. {"sheet": "Jadwal"} for a spreadsheet.
+alter table documents
+add column if not exists mime_type text;
+
+alter table document_pages
+add column if not exists metadata jsonb;
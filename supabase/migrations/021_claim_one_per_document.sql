@@ -0,0 +1,89 @@
+-- At most one processing job per document. Jobs of different kinds can be
+-- queued for the same document (an ingest and a reocr through enqueue_job);
+-- run together, both would rewrite the same pages and chunks. A queued job
+-- whose document already has a processing job waits until that one ends.
+create index if not exists jobs_processing_document_idx
+on jobs (document_id)
+where status = 'processing';
+
+-- Same as 012, but skipping documents that are busy. The advisory lock on
+-- the document keeps two workers from claiming jobs for it at the same
+-- time, before either has committed its claim.
+create or replace function claim_job(
+  p_worker_id text,
+  p_lease_seconds int default 300
+) returns setof jobs
+language plpgsql security definer as $$
+declare
+  candidate record;
+  claimed_id uuid;
+begin
+  for candidate in
+    with running as (
+      select user_id, count(*) as n
+      from jobs
+      where status = 'processing'
+      group by user_id
+    ),
+    queued as (
+      select
+        j.id,
+        j.document_id,
+        j.user_id,
+        j.priority,
+        j.created_at,
+        row_number() over (partition by j.user_id order by j.priority desc, j.created_at asc) as user_rank
+      from jobs j
+      where j.status = 'queued'
+        and (j.next_attempt_at is null or j.next_attempt_at <= now())
+        and not exists (
+          select 1
+          from jobs b
+          where b.document_id = j.document_id
+            and b.status = 'processing'
+        )
+    )
+    select q.id, q.document_id
+    from queued q
+    left join running r on r.user_id = q.user_id
+    order by q.priority desc, coalesce(r.n, 0) asc, q.user_rank asc, q.created_at asc
+    limit 20
+  loop
+    -- Folder jobs have no document
+    if candidate.document_id is not null then
+      if not pg_try_advisory_xact_lock(hashtext('claim_job:' || candidate.document_id::text)) then
+        continue;
+      end if;
+      if exists (
+        select 1
+        from jobs
+        where document_id = candidate.document_id
+          and status = 'processing'
+      ) then
+        continue;
+      end if;
+    end if;
+
+    select id into claimed_id
+    from jobs
+    where id = candidate.id and status = 'queued'
+    for update skip locked;
+
+    if found then
+      return query
+      update jobs
+      set
+        status = 'processing',
+        locked_by = p_worker_id,
+        lease_expires_at = now() + make_interval(secs => p_lease_seconds),
+        next_attempt_at = null,
+        updated_at = now()
+      where id = claimed_id
+      returning *;
+      return;
+    end if;
+  end loop;
+end;
+$$;
+
+revoke execute on function claim_job(text, int) from public, anon, authenticated;
@@ -0,0 +1,46 @@
+-- p_max_attempts counts runs, the first included, as the worker's
+-- max_attempts does. jobs.attempts counts the runs before the current one,
+-- so a reaped job has used attempts + 1 of them. Same as 010 otherwise.
+create or replace function reap_expired_jobs(
+  p_max_attempts int default 3
+) returns setof jobs
+language plpgsql security definer as $$
+begin
+  if not pg_try_advisory_xact_lock(hashtext('reap_expired_jobs')) then
+    return;
+  end if;
+
+  return query
+  with expired as (
+    select id
+    from jobs
+    where status = 'processing'
+      and lease_expires_at < now()
+    for update skip locked
+  ),
+  reaped as (
+    update jobs j
+    set
+      status = case when j.attempts + 1 < p_max_attempts then 'queued' else 'failed' end,
+      attempts = case when j.attempts + 1 < p_max_attempts then j.attempts + 1 else j.attempts end,
+      last_error = 'lease expired (worker ' || coalesce(j.locked_by, 'unknown') || ' stopped heartbeating)',
+      error_code = 'lease_expired',
+      error_kind = 'transient',
+      locked_by = null,
+      lease_expires_at = null,
+      updated_at = now()
+    from expired
+    where j.id = expired.id
+    returning j.*
+  ),
+  failed_docs as (
+    update documents d
+    set status = 'error', updated_at = now()
+    from reaped
+    where reaped.status = 'failed' and d.id = reaped.document_id
+  )
+  select * from reaped;
+end;
+$$;
+
+revoke execute on function reap_expired_jobs(int) from public, anon, authenticated;
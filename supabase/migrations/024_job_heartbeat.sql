@@ -0,0 +1,25 @@
+-- Extend a job's lease from the database clock, the one claim_job and
+-- reap_expired_jobs compare lease_expires_at against. A lease the worker
+-- computed from its own clock would be reaped early if that clock ran
+-- behind, or outlive the worker if it ran ahead. Returns false if the job
+-- is no longer leased to p_worker_id.
+create or replace function heartbeat_job(
+  p_job_id uuid,
+  p_worker_id text,
+  p_lease_seconds int default 300
+) returns boolean
+language sql security definer as $$
+  with renewed as (
+    update jobs
+    set
+      lease_expires_at = now() + make_interval(secs => p_lease_seconds),
+      updated_at = now()
+    where id = p_job_id
+      and locked_by = p_worker_id
+      and status = 'processing'
+    returning 1
+  )
+  select exists (select 1 from renewed);
+$$;
+
+revoke execute on function heartbeat_job(uuid, text, int) from public, anon, authenticated;
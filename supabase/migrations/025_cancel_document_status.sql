@@ -0,0 +1,46 @@
+-- A cancelled ingest leaves its document half processed. Once no ingest job
+-- for the document is queued or running any more, set it to 'error' rather
+-- than leave it 'processing' for good; the cancelled job's last_error says
+-- why. Documents that are deleted with their jobs have nothing to reset.
+create or replace function reset_cancelled_document(
+  p_document_id uuid
+) returns void
+language sql security definer as $$
+  update documents d
+  set status = 'error', updated_at = now()
+  where d.id = p_document_id
+    and d.status = 'processing'
+    and not exists (
+      select 1
+      from jobs j
+      where j.document_id = d.id
+        and j.kind = 'ingest'
+        and j.status in ('queued', 'processing')
+    );
+$$;
+
+-- Same as 015, but queued jobs record why they were cancelled, and the
+-- document is reset if none of its jobs is still running. A running job is
+-- only flagged; its worker resets the document once it has stopped.
+create or replace function cancel_document_jobs(
+  p_document_id uuid
+) returns setof jobs
+language plpgsql security definer as $$
+begin
+  return query
+  update jobs
+  set
+    cancel_requested = true,
+    status = case when status = 'queued' then 'cancelled' else status end,
+    last_error = case when status = 'queued' then 'cancelled before it ran' else last_error end,
+    updated_at = now()
+  where document_id = p_document_id
+    and status in ('queued', 'processing')
+  returning *;
+
+  perform reset_cancelled_document(p_document_id);
+end;
+$$;
+
+revoke execute on function reset_cancelled_document(uuid) from public, anon, authenticated;
+revoke execute on function cancel_document_jobs(uuid) from public, anon, authenticated;
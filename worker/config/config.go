@@ -0,0 +1,512 @@
+// Package config builds the worker's settings from, in increasing order of
+// precedence: built-in defaults, an optional YAML or TOML file, environment
+// variables (including the dotenv file) and command-line flags.
+package config
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/joho/godotenv"
+	"github.com/robfig/cron/v3"
+	"gopkg.in/yaml.v2"
+)
+
+// Config is the effective worker configuration.
+type Config struct {
+	// EnvFile is a dotenv file loaded into the environment before it is read.
+	// Variables already set in the environment win.
+	EnvFile string `yaml:"env_file" toml:"env_file"`
+
+	Supabase    Supabase    `yaml:"supabase" toml:"supabase"`
+	Gemini      Gemini      `yaml:"gemini" toml:"gemini"`
+	Worker      Worker      `yaml:"worker" toml:"worker"`
+	Chunking    Chunking    `yaml:"chunking" toml:"chunking"`
+	OCR         OCR         `yaml:"ocr" toml:"ocr"`
+	Log         Log         `yaml:"log" toml:"log"`
+	Timeouts    Timeouts    `yaml:"timeouts" toml:"timeouts"`
+	Webhooks    Webhooks    `yaml:"webhooks" toml:"webhooks"`
+	Maintenance Maintenance `yaml:"maintenance" toml:"maintenance"`
+	HealthAddr  string      `yaml:"health_addr" toml:"health_addr"`
+}
+
+type Supabase struct {
+	URL        string `yaml:"url" toml:"url"`
+	ServiceKey string `yaml:"service_key" toml:"service_key"`
+	// DatabaseURL is a direct Postgres DSN, used for LISTEN/NOTIFY. Optional.
+	DatabaseURL string `yaml:"database_url" toml:"database_url"`
+	// Bucket is the Storage bucket uploaded documents live in.
+	Bucket string `yaml:"bucket" toml:"bucket"`
+}
+
+type Gemini struct {
+	APIKey         string `yaml:"api_key" toml:"api_key"`
+	OCRModel       string `yaml:"ocr_model" toml:"ocr_model"`
+	EmbeddingModel string `yaml:"embedding_model" toml:"embedding_model"`
+}
+
+type Worker struct {
+	// ID identifies this replica in jobs.locked_by. Defaults to hostname-pid.
+	ID string `yaml:"id" toml:"id"`
+	// Concurrency is how many jobs run at once.
+	Concurrency int `yaml:"concurrency" toml:"concurrency"`
+	// MaxAttempts is how many times a job runs, the first run included,
+	// before it is marked failed.
+	MaxAttempts int `yaml:"max_attempts" toml:"max_attempts"`
+	// ExtractConcurrency caps concurrent CPU-bound extractions (text layer,
+	// page splitting, DOCX) across all jobs.
+	ExtractConcurrency int `yaml:"extract_concurrency" toml:"extract_concurrency"`
+	// APIConcurrency caps concurrent Gemini calls (OCR and embeddings).
+	APIConcurrency int `yaml:"api_concurrency" toml:"api_concurrency"`
+}
+
+type Chunking struct {
+	// Size and Overlap are in characters (runes).
+	Size    int `yaml:"size" toml:"size"`
+	Overlap int `yaml:"overlap" toml:"overlap"`
+}
+
+type OCR struct {
+	// MinTextChars is the shortest text layer trusted without falling back to
+	// Gemini OCR; image-heavy pages often only have a header as text.
+	MinTextChars int `yaml:"min_text_chars" toml:"min_text_chars"`
+}
+
+// Timeouts bound how long work may take, so one stuck connection can't hang
+// a worker slot forever. Zero means no limit.
+type Timeouts struct {
+	// Job bounds a whole job. With page checkpoints a retry resumes where it
+	// stopped, and a run that checkpointed pages before hitting it doesn't
+	// count as an attempt, so it needn't cover a whole large document.
+	Job time.Duration `yaml:"job" toml:"job"`
+	// Page bounds one page from extraction to stored chunks.
+	Page time.Duration `yaml:"page" toml:"page"`
+	// Download bounds fetching the file from Storage.
+	Download time.Duration `yaml:"download" toml:"download"`
+	// OCR and Embedding bound single Gemini calls, not counting the wait
+	// for an API slot.
+	OCR       time.Duration `yaml:"ocr" toml:"ocr"`
+	Embedding time.Duration `yaml:"embedding" toml:"embedding"`
+	// HTTP bounds Supabase requests (PostgREST, RPC), and how long Storage
+	// may take to start answering a download.
+	HTTP time.Duration `yaml:"http" toml:"http"`
+}
+
+// Webhooks configures signed document.* event deliveries. Disabled when
+// URLs is empty.
+type Webhooks struct {
+	URLs []string `yaml:"urls" toml:"urls"`
+	// Secret signs every delivery (HMAC-SHA256); receivers verify with it.
+	Secret string `yaml:"secret" toml:"secret"`
+	// MaxAttempts is how many times a delivery is tried before it is marked failed.
+	MaxAttempts int `yaml:"max_attempts" toml:"max_attempts"`
+	// Timeout bounds a single delivery request.
+	Timeout time.Duration `yaml:"timeout" toml:"timeout"`
+}
+
+// Maintenance schedules the recurring tasks run by whichever replica holds
+// the maintenance lease. Schedules are five-field cron expressions in UTC,
+// e.g. "0 3 * * 0"; "off" disables a task.
+type Maintenance struct {
+	// Reembed queues reembed jobs for documents with chunks missing an embedding.
+	Reembed string `yaml:"reembed" toml:"reembed"`
+	// Reindex rebuilds the ivfflat embedding index. Skipped without DatabaseURL.
+	Reindex string `yaml:"reindex" toml:"reindex"`
+	// Sweep deletes Storage objects no document points to, once they are
+	// older than OrphanMinAge. Folders waiting on an ingest_folder job are
+	// kept; folders staged without one must be queued within OrphanMinAge.
+	Sweep        string        `yaml:"sweep" toml:"sweep"`
+	OrphanMinAge time.Duration `yaml:"orphan_min_age" toml:"orphan_min_age"`
+}
+
+// ScheduleOff disables a maintenance task.
+const ScheduleOff = "off"
+
+type Log struct {
+	Format string `yaml:"format" toml:"format"` // text or json
+	Level  string `yaml:"level" toml:"level"`   // debug, info, warn or error
+}
+
+// Default returns the built-in settings.
+func Default() Config {
+	return Config{
+		EnvFile: "../.env.local",
+		Supabase: Supabase{
+			Bucket: "kai_docs",
+		},
+		Gemini: Gemini{
+			OCRModel:       "gemini-2.5-flash",
+			EmbeddingModel: "text-embedding-004",
+		},
+		Worker: Worker{
+			Concurrency:        2,
+			MaxAttempts:        3,
+			ExtractConcurrency: runtime.NumCPU(),
+			APIConcurrency:     1,
+		},
+		Chunking: Chunking{
+			Size:    1000, // Reduced specifically for embedding context window safety
+			Overlap: 100,
+		},
+		OCR: OCR{
+			MinTextChars: 400,
+		},
+		Log: Log{
+			Format: "text",
+			Level:  "info",
+		},
+		Webhooks: Webhooks{
+			MaxAttempts: 8,
+			Timeout:     10 * time.Second,
+		},
+		Maintenance: Maintenance{
+			Reembed:      "*/30 * * * *",
+			Reindex:      "0 3 * * 0",
+			Sweep:        "0 4 * * *",
+			OrphanMinAge: 24 * time.Hour,
+		},
+		Timeouts: Timeouts{
+			Job:       2 * time.Hour,
+			Page:      10 * time.Minute,
+			Download:  10 * time.Minute,
+			OCR:       time.Minute,
+			Embedding: time.Minute,
+			HTTP:      30 * time.Second,
+		},
+	}
+}
+
+// Options are flags that control loading rather than the worker itself.
+type Options struct {
+	// PrintConfig asks the caller to print the effective config and exit.
+	PrintConfig bool
+}
+
+// Load parses args (without the program name) and returns the validated
+// configuration.
+func Load(args []string) (*Config, Options, error) {
+	var opts Options
+	var configFile, envFile string
+
+	fs := flag.NewFlagSet("worker", flag.ContinueOnError)
+	fs.StringVar(&configFile, "config", os.Getenv("CONFIG_FILE"), "YAML or TOML config file")
+	fs.StringVar(&envFile, "env-file", "", "dotenv file to load (default ../.env.local)")
+	fs.BoolVar(&opts.PrintConfig, "print-config", false, "print the effective configuration (secrets redacted) and exit")
+	flagConcurrency := fs.Int("concurrency", 0, "jobs to run at once")
+	flagMaxAttempts := fs.Int("max-attempts", 0, "runs of a job, the first included, before it is marked failed")
+	flagLogLevel := fs.String("log-level", "", "debug, info, warn or error")
+	flagLogFormat := fs.String("log-format", "", "text or json")
+	flagHealthAddr := fs.String("health-addr", "", "address for /healthz, /readyz and /metrics, e.g. :8080")
+	if err := fs.Parse(args); err != nil {
+		return nil, opts, err
+	}
+
+	cfg := Default()
+	if configFile != "" {
+		if err := cfg.loadFile(configFile); err != nil {
+			return nil, opts, err
+		}
+	}
+
+	if envFile != "" {
+		cfg.EnvFile = envFile
+	}
+	if cfg.EnvFile != "" {
+		err := godotenv.Load(cfg.EnvFile)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return nil, opts, fmt.Errorf("load %s: %w", cfg.EnvFile, err)
+		}
+	}
+
+	if err := cfg.loadEnv(); err != nil {
+		return nil, opts, err
+	}
+
+	// Only flags that were given override the file and environment
+	fs.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "concurrency":
+			cfg.Worker.Concurrency = *flagConcurrency
+		case "max-attempts":
+			cfg.Worker.MaxAttempts = *flagMaxAttempts
+		case "log-level":
+			cfg.Log.Level = *flagLogLevel
+		case "log-format":
+			cfg.Log.Format = *flagLogFormat
+		case "health-addr":
+			cfg.HealthAddr = *flagHealthAddr
+		}
+	})
+
+	if cfg.Worker.ID == "" {
+		host, _ := os.Hostname()
+		cfg.Worker.ID = fmt.Sprintf("%s-%d", host, os.Getpid())
+	}
+
+	if err := cfg.Validate(); err != nil {
+		return nil, opts, err
+	}
+	return &cfg, opts, nil
+}
+
+// loadFile overlays settings from a .yaml/.yml or .toml file.
+func (c *Config) loadFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("read config: %w", err)
+	}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		err = yaml.UnmarshalStrict(data, c)
+	case ".toml":
+		var md toml.MetaData
+		md, err = toml.Decode(string(data), c)
+		if err == nil && len(md.Undecoded()) > 0 {
+			err = fmt.Errorf("unknown keys %v", md.Undecoded())
+		}
+	default:
+		return fmt.Errorf("config file %s: want .yaml, .yml or .toml", path)
+	}
+	if err != nil {
+		return fmt.Errorf("parse %s: %w", path, err)
+	}
+	return nil
+}
+
+// loadEnv overlays settings from environment variables that are set.
+func (c *Config) loadEnv() error {
+	envString("NEXT_PUBLIC_SUPABASE_URL", &c.Supabase.URL)
+	envString("SUPABASE_SERVICE_ROLE_KEY", &c.Supabase.ServiceKey)
+	envString("DATABASE_URL", &c.Supabase.DatabaseURL)
+	envString("STORAGE_BUCKET", &c.Supabase.Bucket)
+
+	// GEMINI_API_KEY may hold a comma-separated list; only the first is used
+	if key := os.Getenv("GEMINI_API_KEY"); key != "" {
+		c.Gemini.APIKey = strings.TrimSpace(strings.Split(key, ",")[0])
+	}
+	envString("GEMINI_OCR_MODEL", &c.Gemini.OCRModel)
+	envString("GEMINI_EMBEDDING_MODEL", &c.Gemini.EmbeddingModel)
+
+	envString("WORKER_ID", &c.Worker.ID)
+	envString("HEALTH_ADDR", &c.HealthAddr)
+	envString("LOG_FORMAT", &c.Log.Format)
+	envString("LOG_LEVEL", &c.Log.Level)
+	envString("WEBHOOK_SECRET", &c.Webhooks.Secret)
+	envString("MAINTENANCE_REEMBED", &c.Maintenance.Reembed)
+	envString("MAINTENANCE_REINDEX", &c.Maintenance.Reindex)
+	envString("MAINTENANCE_SWEEP", &c.Maintenance.Sweep)
+
+	// WEBHOOK_URLS is a comma-separated list
+	if v := os.Getenv("WEBHOOK_URLS"); v != "" {
+		c.Webhooks.URLs = nil
+		for _, u := range strings.Split(v, ",") {
+			if u = strings.TrimSpace(u); u != "" {
+				c.Webhooks.URLs = append(c.Webhooks.URLs, u)
+			}
+		}
+	}
+
+	for name, dst := range map[string]*int{
+		"WORKER_CONCURRENCY":   &c.Worker.Concurrency,
+		"MAX_ATTEMPTS":         &c.Worker.MaxAttempts,
+		"EXTRACT_CONCURRENCY":  &c.Worker.ExtractConcurrency,
+		"API_CONCURRENCY":      &c.Worker.APIConcurrency,
+		"CHUNK_SIZE":           &c.Chunking.Size,
+		"CHUNK_OVERLAP":        &c.Chunking.Overlap,
+		"OCR_MIN_TEXT_CHARS":   &c.OCR.MinTextChars,
+		"WEBHOOK_MAX_ATTEMPTS": &c.Webhooks.MaxAttempts,
+	} {
+		if err := envInt(name, dst); err != nil {
+			return err
+		}
+	}
+
+	for name, dst := range map[string]*time.Duration{
+		"JOB_TIMEOUT":       &c.Timeouts.Job,
+		"PAGE_TIMEOUT":      &c.Timeouts.Page,
+		"DOWNLOAD_TIMEOUT":  &c.Timeouts.Download,
+		"OCR_TIMEOUT":       &c.Timeouts.OCR,
+		"EMBEDDING_TIMEOUT": &c.Timeouts.Embedding,
+		"HTTP_TIMEOUT":      &c.Timeouts.HTTP,
+		"WEBHOOK_TIMEOUT":   &c.Webhooks.Timeout,
+		"ORPHAN_MIN_AGE":    &c.Maintenance.OrphanMinAge,
+	} {
+		if err := envDuration(name, dst); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func envString(name string, dst *string) {
+	if v := os.Getenv(name); v != "" {
+		*dst = v
+	}
+}
+
+func envInt(name string, dst *int) error {
+	v := os.Getenv(name)
+	if v == "" {
+		return nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		return fmt.Errorf("%s=%q: not an integer", name, v)
+	}
+	*dst = n
+	return nil
+}
+
+func envDuration(name string, dst *time.Duration) error {
+	v := os.Getenv(name)
+	if v == "" {
+		return nil
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		return fmt.Errorf("%s=%q: not a duration (e.g. 90s, 10m)", name, v)
+	}
+	*dst = d
+	return nil
+}
+
+// Validate reports every invalid setting at once.
+func (c *Config) Validate() error {
+	var errs []error
+	check := func(ok bool, format string, args ...any) {
+		if !ok {
+			errs = append(errs, fmt.Errorf(format, args...))
+		}
+	}
+
+	check(c.Supabase.URL != "", "supabase url is required (NEXT_PUBLIC_SUPABASE_URL)")
+	check(c.Supabase.ServiceKey != "", "supabase service key is required (SUPABASE_SERVICE_ROLE_KEY)")
+	check(c.Supabase.Bucket != "", "storage bucket must not be empty")
+	if c.Supabase.URL != "" {
+		u, err := url.Parse(c.Supabase.URL)
+		check(err == nil && u.Scheme != "" && u.Host != "", "supabase url %q is not an absolute URL", c.Supabase.URL)
+	}
+
+	check(c.Gemini.OCRModel != "", "gemini ocr model must not be empty")
+	check(c.Gemini.EmbeddingModel != "", "gemini embedding model must not be empty")
+
+	check(c.Worker.Concurrency >= 1, "worker concurrency must be at least 1, got %d", c.Worker.Concurrency)
+	check(c.Worker.MaxAttempts >= 1, "max attempts must be at least 1, got %d", c.Worker.MaxAttempts)
+	check(c.Worker.ExtractConcurrency >= 1, "extract concurrency must be at least 1, got %d", c.Worker.ExtractConcurrency)
+	check(c.Worker.APIConcurrency >= 1, "api concurrency must be at least 1, got %d", c.Worker.APIConcurrency)
+
+	check(c.Chunking.Size >= 1, "chunk size must be at least 1, got %d", c.Chunking.Size)
+	check(c.Chunking.Overlap >= 0 && c.Chunking.Overlap < c.Chunking.Size,
+		"chunk overlap must be between 0 and chunk size (%d), got %d", c.Chunking.Size, c.Chunking.Overlap)
+	check(c.OCR.MinTextChars >= 0, "ocr min text chars must not be negative, got %d", c.OCR.MinTextChars)
+
+	for _, t := range []struct {
+		name string
+		d    time.Duration
+	}{
+		{"job", c.Timeouts.Job},
+		{"page", c.Timeouts.Page},
+		{"download", c.Timeouts.Download},
+		{"ocr", c.Timeouts.OCR},
+		{"embedding", c.Timeouts.Embedding},
+		{"http", c.Timeouts.HTTP},
+		{"webhook", c.Webhooks.Timeout},
+	} {
+		check(t.d >= 0, "%s timeout must not be negative, got %s", t.name, t.d)
+	}
+
+	if len(c.Webhooks.URLs) > 0 {
+		check(c.Webhooks.Secret != "", "webhook secret is required when webhook urls are set (WEBHOOK_SECRET)")
+		check(c.Webhooks.MaxAttempts >= 1, "webhook max attempts must be at least 1, got %d", c.Webhooks.MaxAttempts)
+		for _, raw := range c.Webhooks.URLs {
+			u, err := url.Parse(raw)
+			check(err == nil && (u.Scheme == "https" || u.Scheme == "http") && u.Host != "",
+				"webhook url %q is not an http(s) URL", raw)
+		}
+	}
+
+	for _, s := range []struct {
+		name string
+		spec string
+	}{
+		{"reembed", c.Maintenance.Reembed},
+		{"reindex", c.Maintenance.Reindex},
+		{"sweep", c.Maintenance.Sweep},
+	} {
+		if s.spec == ScheduleOff {
+			continue
+		}
+		_, err := cron.ParseStandard(s.spec)
+		check(err == nil, "maintenance %s schedule %q is not a cron expression (or %q): %v", s.name, s.spec, ScheduleOff, err)
+	}
+	// Uploads land in Storage before their document row points at them
+	check(c.Maintenance.OrphanMinAge >= time.Hour, "orphan min age must be at least 1h, got %s", c.Maintenance.OrphanMinAge)
+
+	switch strings.ToLower(c.Log.Format) {
+	case "text", "json":
+	default:
+		errs = append(errs, fmt.Errorf("log format must be text or json, got %q", c.Log.Format))
+	}
+	switch strings.ToLower(c.Log.Level) {
+	case "debug", "info", "warn", "error":
+	default:
+		errs = append(errs, fmt.Errorf("log level must be debug, info, warn or error, got %q", c.Log.Level))
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("invalid configuration: %w", errors.Join(errs...))
+	}
+	return nil
+}
+
+const redacted = "[redacted]"
+
+// Redacted returns a copy of c that is safe to print or log.
+func (c Config) Redacted() Config {
+	if c.Supabase.ServiceKey != "" {
+		c.Supabase.ServiceKey = redacted
+	}
+	if c.Gemini.APIKey != "" {
+		c.Gemini.APIKey = redacted
+	}
+	if c.Webhooks.Secret != "" {
+		c.Webhooks.Secret = redacted
+	}
+	urls := make([]string, len(c.Webhooks.URLs))
+	for i, raw := range c.Webhooks.URLs {
+		urls[i] = raw
+		if u, err := url.Parse(raw); err == nil {
+			urls[i] = u.Redacted()
+		}
+	}
+	c.Webhooks.URLs = urls
+	if c.Supabase.DatabaseURL != "" {
+		// Keep the host for debugging; key=value DSNs are hidden entirely
+		if u, err := url.Parse(c.Supabase.DatabaseURL); err == nil && u.Scheme != "" {
+			c.Supabase.DatabaseURL = u.Redacted()
+		} else {
+			c.Supabase.DatabaseURL = redacted
+		}
+	}
+	return c
+}
+
+// Print writes the effective configuration as YAML, with secrets redacted.
+func (c Config) Print(w io.Writer) error {
+	out, err := yaml.Marshal(c.Redacted())
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(out)
+	return err
+}
@@ -0,0 +1,132 @@
+// Package health serves the worker's optional /healthz, /readyz and
+// /metrics endpoints for the orchestrator and Prometheus.
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"kai-worker/metrics"
+)
+
+// Check reports whether one dependency is usable.
+type Check func(ctx context.Context) error
+
+// Server exposes liveness, readiness and metrics over HTTP.
+type Server struct {
+	addr       string
+	maxSilence time.Duration
+
+	mu     sync.Mutex
+	names  []string
+	checks map[string]Check
+
+	stopping chan struct{}
+}
+
+// NewServer returns a Server listening on addr. /healthz fails once the job
+// loop has shown no activity (poll or heartbeat) for maxSilence, which is
+// how a hung worker is told apart from an idle one.
+func NewServer(addr string, maxSilence time.Duration) *Server {
+	return &Server{
+		addr:       addr,
+		maxSilence: maxSilence,
+		checks:     map[string]Check{},
+		stopping:   make(chan struct{}),
+	}
+}
+
+// AddReadinessCheck registers a dependency checked by /readyz.
+func (s *Server) AddReadinessCheck(name string, check Check) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.checks[name]; !ok {
+		s.names = append(s.names, name)
+	}
+	s.checks[name] = check
+}
+
+// Run serves until ctx is cancelled. Once ctx is done /readyz reports not
+// ready while in-flight jobs drain; the listener itself stays up until stop
+// is closed so the orchestrator can keep probing liveness.
+func (s *Server) Run(ctx context.Context, stop <-chan struct{}) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", s.handleHealthz)
+	mux.HandleFunc("/readyz", s.handleReadyz)
+	mux.Handle("/metrics", promhttp.Handler())
+
+	srv := &http.Server{
+		Addr:              s.addr,
+		Handler:           mux,
+		ReadHeaderTimeout: 5 * time.Second,
+	}
+
+	go func() {
+		<-ctx.Done()
+		close(s.stopping)
+		<-stop
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		srv.Shutdown(shutdownCtx)
+	}()
+
+	slog.InfoContext(ctx, "Health server listening", "addr", s.addr)
+	if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		slog.ErrorContext(ctx, "Health server stopped", "error", err)
+	}
+}
+
+func (s *Server) handleHealthz(w http.ResponseWriter, r *http.Request) {
+	if silent := metrics.SinceLastActivity(); silent > s.maxSilence {
+		writeJSON(w, http.StatusServiceUnavailable, map[string]interface{}{
+			"status": "stalled",
+			"silent": silent.Round(time.Second).String(),
+		})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"status": "ok"})
+}
+
+func (s *Server) handleReadyz(w http.ResponseWriter, r *http.Request) {
+	select {
+	case <-s.stopping:
+		writeJSON(w, http.StatusServiceUnavailable, map[string]interface{}{"status": "shutting down"})
+		return
+	default:
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	s.mu.Lock()
+	names := append([]string(nil), s.names...)
+	checks := make(map[string]Check, len(s.checks))
+	for k, v := range s.checks {
+		checks[k] = v
+	}
+	s.mu.Unlock()
+
+	status := http.StatusOK
+	results := map[string]string{}
+	for _, name := range names {
+		if err := checks[name](ctx); err != nil {
+			status = http.StatusServiceUnavailable
+			results[name] = err.Error()
+		} else {
+			results[name] = "ok"
+		}
+	}
+	writeJSON(w, status, results)
+}
+
+func writeJSON(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
@@ -1,129 +1,423 @@
-package main
-
-import (
-	"log"
-	"os"
-	"time"
-
-	"github.com/joho/godotenv"
-	"github.com/supabase-community/postgrest-go"
-	"github.com/supabase-community/supabase-go"
-	"kai-worker/processor"
-)
-
-func main() {
-	_ = godotenv.Load("../.env.local")
-
-	apiUrl := os.Getenv("NEXT_PUBLIC_SUPABASE_URL")
-	serviceKey := os.Getenv("SUPABASE_SERVICE_ROLE_KEY")
-
-	if apiUrl == "" || serviceKey == "" {
-		log.Fatal("Missing supabase credentials")
-	}
-
-	client, err := supabase.NewClient(apiUrl, serviceKey, nil)
-	if err != nil {
-		log.Fatal("Failed to init supabase client:", err)
-	}
-
-	log.Println("Worker started. Polling for jobs...")
-
-	proc := processor.NewProcessor(client, apiUrl, serviceKey)
-
-	for {
-		// Poll for jobs
-		// 1. Fetch a queued job
-		var jobs []processor.Job
-		// Order expects (column, *OrderOpts)
-		// Limit expects (count, foreignTable) - passing "" for foreignTable
-		_, err := client.From("jobs").
-			Select("*", "exact", false).
-			Eq("status", "queued").
-			Order("created_at", &postgrest.OrderOpts{Ascending: true}).
-			Limit(1, "").
-			ExecuteTo(&jobs)
-
-		if err != nil {
-			log.Println("Error polling jobs:", err)
-			time.Sleep(5 * time.Second)
-			continue
-		}
-
-		if len(jobs) == 0 {
-			time.Sleep(2 * time.Second) // Idle wait
-			continue
-		}
-
-		job := jobs[0]
-
-		// 2. Lock job (Optimistic handling)
-		// Update: (value, count, returning) -> "representation"
-		var updated []processor.Job
-		_, err = client.From("jobs").
-			Update(map[string]interface{}{
-				"status": "processing", 
-				"updated_at": time.Now(),
-			}, "", "representation").
-			Eq("id", job.ID).
-			Eq("status", "queued"). // Safety check
-			ExecuteTo(&updated)
-
-		if err != nil || len(updated) == 0 {
-			// Another worker took it or error
-			continue
-		}
-
-		log.Printf("Processing job %s for document %s", job.ID, job.DocumentID)
-
-		// 3. Process
-		// dendy-code-process
-		err = proc.ProcessJob(job)
-		
-		status := "completed"
-		lastError := ""
-		if err != nil {
-		    log.Printf("Job %s failed: %v", job.ID, err)
-			status = "failed"
-			lastError = err.Error()
-			
-			if job.Attempts < 3 {
-			    status = "queued" // Re-queue
-			} else {
-                 // Final failure, mark document as error
-                 client.From("documents").Update(map[string]interface{}{
-                    "status": "error",
-                 }, "", "").Eq("id", job.DocumentID).Execute()
-            }
-		} else {
-            // Success! Mark document as ready
-            _, _, errDoc := client.From("documents").Update(map[string]interface{}{
-                "status": "ready",
-            }, "", "").Eq("id", job.DocumentID).Execute()
-            
-            if errDoc != nil {
-                log.Println("Failed to update document status to ready:", errDoc)
-            }
-        }
-
-		// 4. Update Final Status
-		updateData := map[string]interface{}{
-			"status": status,
-			"updated_at": time.Now(),
-		}
-		if lastError != "" {
-			updateData["last_error"] = lastError
-		}
-		if status == "queued" {
-		    updateData["attempts"] = job.Attempts + 1
-		}
-
-		_, _, err = client.From("jobs").
-			Update(updateData, "", "representation").
-			Eq("id", job.ID).
-			Execute()
-            
-        if err != nil {
-            log.Println("Failed to update final job status:", err)
-        }
-	}
-}
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"log/slog"
+	"math/rand/v2"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/supabase-community/supabase-go"
+	"kai-worker/config"
+	"kai-worker/health"
+	"kai-worker/logging"
+	"kai-worker/maintenance"
+	"kai-worker/metrics"
+	"kai-worker/notify"
+	"kai-worker/processor"
+	"kai-worker/queue"
+	"kai-worker/rpc"
+	"kai-worker/webhook"
+)
+
+// leaseDuration is how long a claimed job belongs to this worker before
+// another replica may consider it abandoned.
+const leaseDuration = 5 * time.Minute
+
+// heartbeatInterval keeps the lease comfortably ahead of expiry while a job runs.
+const heartbeatInterval = leaseDuration / 3
+
+// reapInterval is how often each replica offers to sweep expired leases.
+// The RPC itself guarantees only one of them actually does the work.
+const reapInterval = time.Minute
+
+// idlePollInterval is how often an idle slot polls when the worker runs
+// without job notifications (no DATABASE_URL). With them, notifyPollInterval
+// is the slow poll behind the subscription: it catches retries whose
+// next_attempt_at passes silently, and carries on alone while the
+// subscription is down and reconnecting.
+const (
+	idlePollInterval   = 2 * time.Second
+	notifyPollInterval = 30 * time.Second
+)
+
+// cancelCheckInterval is how often a running job checks whether it was
+// cancelled (cancel_requested set, or its document deleted).
+const cancelCheckInterval = 5 * time.Second
+
+// healthMaxSilence is how long the job loop may go without polling or
+// heartbeating before /healthz reports the worker as stalled.
+const healthMaxSilence = 2 * heartbeatInterval
+
+// queueDepthInterval is how often the queue depth gauge is refreshed.
+const queueDepthInterval = 30 * time.Second
+
+// shutdownGrace is how long in-flight jobs may keep running after SIGTERM/SIGINT
+// before their context is cancelled and they are released back to the queue.
+const shutdownGrace = 30 * time.Second
+
+// Failed jobs are retried after retryBaseDelay * 2^attempts (capped at
+// retryMaxDelay) plus up to 50% jitter, so a Gemini 429 gets time to clear
+// instead of burning the whole retry budget in a few seconds.
+const (
+	retryBaseDelay = 30 * time.Second
+	retryMaxDelay  = 30 * time.Minute
+)
+
+func main() {
+	cfg, opts, err := config.Load(os.Args[1:])
+	if errors.Is(err, flag.ErrHelp) {
+		return
+	}
+	if err != nil {
+		slog.Error("Invalid configuration", "error", err)
+		os.Exit(2)
+	}
+	if opts.PrintConfig {
+		if err := cfg.Print(os.Stdout); err != nil {
+			slog.Error("Failed to print configuration", "error", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	// log.format=json for log shippers; log.level=debug for per-page progress
+	logger, err := logging.New(os.Stderr, cfg.Log.Format, cfg.Log.Level)
+	if err != nil {
+		slog.Error("Invalid logging configuration", "error", err)
+		os.Exit(2)
+	}
+	slog.SetDefault(logger)
+
+	// supabase-go takes neither a context nor an http.Client, and sends
+	// PostgREST requests through http.DefaultTransport; bound them there
+	if t, ok := http.DefaultTransport.(*http.Transport); ok {
+		t.ResponseHeaderTimeout = cfg.Timeouts.HTTP
+	}
+
+	client, err := supabase.NewClient(cfg.Supabase.URL, cfg.Supabase.ServiceKey, nil)
+	if err != nil {
+		slog.Error("Failed to init supabase client", "error", err)
+		os.Exit(1)
+	}
+
+	// ctx is cancelled on SIGTERM/SIGINT: stop claiming, then drain
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	slog.Info("Worker started", "worker_id", cfg.Worker.ID, "jobs", cfg.Worker.Concurrency,
+		"extract", cfg.Worker.ExtractConcurrency, "api", cfg.Worker.APIConcurrency, "max_attempts", cfg.Worker.MaxAttempts)
+
+	rpcClient := rpc.New(cfg.Supabase.URL, cfg.Supabase.ServiceKey, cfg.Timeouts.HTTP)
+	hooks := webhook.NewDispatcher(client, rpcClient, cfg.Webhooks)
+	w := &worker{
+		queue: queue.NewSupabase(client, rpcClient, leaseDuration),
+		hooks: hooks,
+		proc:  processor.NewProcessor(client, cfg),
+		cfg:   cfg,
+	}
+
+	if dsn := cfg.Supabase.DatabaseURL; dsn != "" {
+		w.listener = notify.NewListener(dsn, "job_queued", cfg.Worker.Concurrency)
+		go w.listener.Run(ctx)
+	} else {
+		slog.Info("DATABASE_URL not set; polling for jobs without notifications")
+	}
+
+	// Optional probes and metrics, e.g. HEALTH_ADDR=:8080
+	drained := make(chan struct{})
+	if addr := cfg.HealthAddr; addr != "" {
+		srv := health.NewServer(addr, healthMaxSilence)
+		srv.AddReadinessCheck("supabase", func(ctx context.Context) error {
+			_, _, err := client.From("jobs").Select("id", "", true).Limit(1, "").Execute()
+			return err
+		})
+		srv.AddReadinessCheck("gemini", w.proc.GeminiReady)
+		go srv.Run(ctx, drained)
+		go runQueueDepthSampler(ctx, w.queue)
+	}
+
+	go runReaper(ctx, w.queue, w.hooks, cfg.Worker.MaxAttempts)
+
+	if hooks.Enabled() {
+		go hooks.Run(ctx)
+	}
+
+	// Every replica stands for election; only the leader runs maintenance
+	sched := maintenance.NewScheduler(client, rpcClient, cfg.Worker.ID)
+	if err := registerMaintenance(sched, cfg, client, rpcClient); err != nil {
+		slog.Error("Invalid maintenance schedule", "error", err)
+		os.Exit(2)
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		sched.Run(ctx)
+	}()
+	for slot := 0; slot < cfg.Worker.Concurrency; slot++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			w.run(ctx)
+		}()
+	}
+	wg.Wait()
+	close(drained)
+
+	slog.Info("Worker stopped", "worker_id", cfg.Worker.ID)
+}
+
+// worker holds what each job slot in the pool needs to claim and run jobs.
+// Slots share one Processor, which enforces the extraction and API limits.
+type worker struct {
+	queue queue.Queue
+	hooks queue.Emitter
+	proc  *processor.Processor
+	cfg   *config.Config
+
+	// listener is nil when DATABASE_URL isn't configured.
+	listener *notify.Listener
+}
+
+// run claims and processes jobs one at a time until ctx is cancelled.
+func (w *worker) run(ctx context.Context) {
+	for ctx.Err() == nil {
+		// 1. Claim a queued job (select + lock + lease in one call)
+		job, err := w.queue.Claim(ctx, w.cfg.Worker.ID)
+		if err != nil {
+			slog.ErrorContext(ctx, "Error claiming job", "error", err)
+			sleepCtx(ctx, 5*time.Second)
+			continue
+		}
+		metrics.PollSucceeded()
+
+		if job == nil {
+			w.waitForWork(ctx) // Idle wait
+			continue
+		}
+
+		metrics.JobsClaimed.Inc()
+		w.handleJob(ctx, job)
+	}
+}
+
+// waitForWork blocks until a job notification arrives or the poll interval
+// elapses. Without notifications configured it polls at idlePollInterval.
+func (w *worker) waitForWork(ctx context.Context) {
+	if w.listener == nil {
+		sleepCtx(ctx, idlePollInterval)
+		return
+	}
+
+	t := time.NewTimer(notifyPollInterval)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+	case <-w.listener.C():
+	case <-t.C:
+	}
+}
+
+// handleJob processes a claimed job and records its outcome.
+func (w *worker) handleJob(ctx context.Context, job *processor.Job) {
+	ctx = logging.With(ctx, "job_id", job.ID, "document_id", job.DocumentID)
+	slog.InfoContext(ctx, "Processing job", "kind", string(job.Kind), "user_id", job.UserID,
+		"priority", job.Priority, "attempt", job.Attempts+1, "max_attempts", w.cfg.Worker.MaxAttempts)
+	if job.Attempts == 0 && job.Kind.OwnsDocumentStatus() {
+		w.hooks.Emit(ctx, webhook.DocumentProcessing, job, nil)
+	}
+
+	// 2. Process, extending the lease until the job returns.
+	// The job outlives ctx by shutdownGrace so a deploy doesn't cut a page in half.
+	jobCtx, cancelJob := context.WithCancelCause(context.WithoutCancel(ctx))
+	stopGrace := context.AfterFunc(ctx, func() {
+		slog.InfoContext(ctx, "Shutdown requested; letting job finish", "grace", shutdownGrace)
+		time.AfterFunc(shutdownGrace, func() { cancelJob(queue.ErrShutdown) })
+	})
+	stopHeartbeat := startHeartbeat(jobCtx, cancelJob, w.queue, job.ID, w.cfg.Worker.ID)
+	stopWatch := watchCancellation(jobCtx, cancelJob, w.queue, job.ID)
+
+	// dendy-code-process
+	metrics.JobsInFlight.Inc()
+	err := w.proc.ProcessJob(jobCtx, *job)
+	metrics.JobsInFlight.Dec()
+
+	stopWatch()
+	stopHeartbeat()
+	stopGrace()
+	cause := context.Cause(jobCtx)
+	cancelJob(nil)
+
+	// 3. Record the outcome and release the lease, even if shutdown has
+	// cancelled ctx
+	policy := queue.RetryPolicy{MaxAttempts: w.cfg.Worker.MaxAttempts, Delay: retryDelay}
+	queue.Settle(context.WithoutCancel(ctx), w.queue, w.hooks, w.cfg.Worker.ID, policy, job, err, cause)
+}
+
+// watchCancellation polls the job row every cancelCheckInterval and cancels
+// the job once cancel_requested is set or the row disappears (deleting a
+// document cascades to its jobs). Returns a func that stops watching.
+func watchCancellation(ctx context.Context, cancel context.CancelCauseFunc, q queue.Queue, jobID string) func() {
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(cancelCheckInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				cancelled, err := q.CancelRequested(ctx, jobID)
+				if err != nil {
+					slog.WarnContext(ctx, "Cancellation check failed", "error", err)
+					continue
+				}
+				if cancelled {
+					slog.InfoContext(ctx, "Job was cancelled; stopping")
+					cancel(queue.ErrCancelled)
+					return
+				}
+			}
+		}
+	}()
+	return func() { close(done) }
+}
+
+// startHeartbeat extends the job's lease every heartbeatInterval until the
+// returned stop function is called. If the lease is lost the job is cancelled,
+// since another worker may already be processing it.
+func startHeartbeat(ctx context.Context, cancel context.CancelCauseFunc, q queue.Queue, jobID, workerID string) func() {
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(heartbeatInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				err := q.Heartbeat(ctx, jobID, workerID)
+				switch {
+				case errors.Is(err, queue.ErrLeaseLost):
+					slog.WarnContext(ctx, "Lost lease; another worker may have reclaimed the job")
+					cancel(queue.ErrLeaseLost)
+					return
+				case err != nil:
+					slog.WarnContext(ctx, "Heartbeat failed", "error", err)
+				default:
+					metrics.Heartbeat()
+				}
+			}
+		}
+	}()
+	return func() { close(done) }
+}
+
+// registerMaintenance adds the maintenance tasks that cfg doesn't switch off.
+func registerMaintenance(s *maintenance.Scheduler, cfg *config.Config, client *supabase.Client, rpcClient *rpc.Client) error {
+	type scheduled struct {
+		name string
+		spec string
+		run  maintenance.TaskFunc
+	}
+	m := cfg.Maintenance
+	tasks := []scheduled{
+		{"reembed_missing", m.Reembed, maintenance.ReembedMissing(rpcClient)},
+		{"sweep_orphans", m.Sweep, maintenance.SweepOrphans(client, rpcClient, cfg.Supabase.Bucket, m.OrphanMinAge)},
+	}
+	if dsn := cfg.Supabase.DatabaseURL; dsn != "" {
+		tasks = append(tasks, scheduled{"reindex_embeddings", m.Reindex, maintenance.ReindexEmbeddings(dsn)})
+	} else if m.Reindex != config.ScheduleOff {
+		slog.Info("DATABASE_URL not set; the reindex maintenance task is disabled")
+	}
+
+	for _, t := range tasks {
+		if t.spec == config.ScheduleOff {
+			continue
+		}
+		if err := s.Register(t.name, t.spec, t.run); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// runReaper periodically returns jobs with expired leases to the queue, or
+// fails them once they have used up maxAttempts.
+func runReaper(ctx context.Context, q queue.Queue, hooks queue.Emitter, maxAttempts int) {
+	ticker := time.NewTicker(reapInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		reaped, err := q.ReapExpired(ctx, maxAttempts)
+		if err != nil {
+			slog.ErrorContext(ctx, "Error reaping expired jobs", "error", err)
+			continue
+		}
+		for _, j := range reaped {
+			slog.WarnContext(ctx, "Reaped expired job", "job_id", j.ID, "document_id", j.DocumentID,
+				"status", j.Status, "attempts", j.Attempts)
+			if j.Status == "failed" && j.Kind.OwnsDocumentStatus() {
+				hooks.Emit(ctx, webhook.DocumentFailed, &j, processor.Transient(j.ErrorCode, errors.New("lease expired")))
+			}
+		}
+	}
+}
+
+// runQueueDepthSampler keeps the queue depth gauge current for /metrics.
+func runQueueDepthSampler(ctx context.Context, q queue.Queue) {
+	ticker := time.NewTicker(queueDepthInterval)
+	defer ticker.Stop()
+	for {
+		count, err := q.Depth(ctx)
+		if err != nil {
+			slog.WarnContext(ctx, "Error sampling queue depth", "error", err)
+		} else {
+			metrics.QueueDepth.Set(float64(count))
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// sleepCtx sleeps for d or until ctx is cancelled, whichever comes first.
+func sleepCtx(ctx context.Context, d time.Duration) {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+	case <-t.C:
+	}
+}
+
+// retryDelay returns the backoff before retry number attempt+1:
+// exponential in attempt, capped, with random jitter so that jobs failing
+// together (e.g. on one quota error) don't all come back at the same instant.
+func retryDelay(attempt int) time.Duration {
+	delay := retryMaxDelay
+	if attempt < 16 {
+		delay = min(retryBaseDelay<<attempt, retryMaxDelay)
+	}
+	return delay + rand.N(delay/2+1)
+}
@@ -0,0 +1,282 @@
+// Package maintenance runs recurring housekeeping tasks on cron schedules.
+//
+// Every replica runs a Scheduler, but only the one holding the lease in
+// maintenance_leader runs tasks; the others keep asking for it and take over
+// once it lapses. When each task runs next and how its last run went are
+// kept in maintenance_runs, so restarts and leader changes neither skip nor
+// repeat runs.
+package maintenance
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/robfig/cron/v3"
+	"github.com/supabase-community/supabase-go"
+	"kai-worker/logging"
+	"kai-worker/metrics"
+	"kai-worker/rpc"
+)
+
+// leaseDuration is how long the leader keeps the lease without renewing it.
+const leaseDuration = 2 * time.Minute
+
+// checkInterval is how often the lease is renewed, or asked for, and due
+// tasks are looked for.
+const checkInterval = 30 * time.Second
+
+// errLeaseLost cancels a running task when another replica took the lease.
+var errLeaseLost = errors.New("maintenance lease lost")
+
+// TaskFunc does one run of a task and returns a one-line summary of what it
+// did, stored in maintenance_runs.last_result.
+type TaskFunc func(ctx context.Context) (string, error)
+
+type task struct {
+	name     string
+	spec     string
+	schedule cron.Schedule
+	run      TaskFunc
+}
+
+// state is a task's row in maintenance_runs.
+type state struct {
+	Task      string    `json:"task"`
+	Schedule  string    `json:"schedule"`
+	NextRunAt time.Time `json:"next_run_at"`
+	RunCount  int       `json:"run_count"`
+}
+
+// Scheduler runs registered tasks when they are due, on the replica that
+// holds the maintenance lease.
+type Scheduler struct {
+	client   *supabase.Client
+	rpc      *rpc.Client
+	workerID string
+	tasks    []task
+	leader   bool
+}
+
+func NewScheduler(client *supabase.Client, rpcClient *rpc.Client, workerID string) *Scheduler {
+	return &Scheduler{client: client, rpc: rpcClient, workerID: workerID}
+}
+
+// Register adds a task that runs on spec, a five-field cron expression
+// evaluated in UTC.
+func (s *Scheduler) Register(name, spec string, run TaskFunc) error {
+	schedule, err := cron.ParseStandard("TZ=UTC " + spec)
+	if err != nil {
+		return fmt.Errorf("maintenance task %s: %w", name, err)
+	}
+	s.tasks = append(s.tasks, task{name: name, spec: spec, schedule: schedule, run: run})
+	return nil
+}
+
+// Run takes part in leader election and, while leader, runs due tasks one
+// at a time, until ctx is cancelled.
+func (s *Scheduler) Run(ctx context.Context) {
+	if len(s.tasks) == 0 {
+		return
+	}
+
+	ticker := time.NewTicker(checkInterval)
+	defer ticker.Stop()
+	for {
+		if s.elect(ctx) {
+			s.runDue(ctx)
+		}
+
+		select {
+		case <-ctx.Done():
+			if s.leader {
+				// Hand over now rather than when the lease runs out
+				err := s.rpc.Call(context.WithoutCancel(ctx), "release_maintenance_lease", map[string]interface{}{
+					"p_worker_id": s.workerID,
+				}, nil)
+				if err != nil {
+					slog.WarnContext(ctx, "Failed to release maintenance lease", "error", err)
+				}
+				metrics.MaintenanceLeader.Set(0)
+			}
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// elect takes or renews the lease and reports whether this worker holds it.
+func (s *Scheduler) elect(ctx context.Context) bool {
+	held, err := s.acquire(ctx)
+	if err != nil {
+		if ctx.Err() == nil {
+			slog.WarnContext(ctx, "Maintenance lease check failed", "error", err)
+		}
+		return false
+	}
+	if held != s.leader {
+		if held {
+			slog.InfoContext(ctx, "Became maintenance leader", "tasks", len(s.tasks))
+			metrics.MaintenanceLeader.Set(1)
+		} else {
+			slog.InfoContext(ctx, "Another worker holds the maintenance lease")
+			metrics.MaintenanceLeader.Set(0)
+		}
+		s.leader = held
+	}
+	return held
+}
+
+func (s *Scheduler) acquire(ctx context.Context) (bool, error) {
+	var held bool
+	err := s.rpc.Call(ctx, "acquire_maintenance_lease", map[string]interface{}{
+		"p_worker_id":     s.workerID,
+		"p_lease_seconds": int(leaseDuration.Seconds()),
+	}, &held)
+	return held, err
+}
+
+// runDue runs every task whose next_run_at has passed. New tasks, and tasks
+// whose schedule changed, are first scheduled rather than run at once.
+func (s *Scheduler) runDue(ctx context.Context) {
+	var rows []state
+	_, err := s.client.From("maintenance_runs").
+		Select("task, schedule, next_run_at, run_count", "", false).
+		ExecuteTo(&rows)
+	if err != nil {
+		slog.WarnContext(ctx, "Failed to load maintenance state", "error", err)
+		return
+	}
+	states := make(map[string]state, len(rows))
+	for _, st := range rows {
+		states[st.Task] = st
+	}
+
+	for _, t := range s.tasks {
+		now := time.Now()
+		st, ok := states[t.name]
+		if !ok || st.Schedule != t.spec {
+			next := t.schedule.Next(now)
+			s.save(ctx, t.name, map[string]interface{}{
+				"schedule":    t.spec,
+				"next_run_at": next,
+				"updated_at":  now,
+			})
+			slog.InfoContext(ctx, "Scheduled maintenance task", "task", t.name, "schedule", t.spec, "next_run_at", next)
+			continue
+		}
+		if st.NextRunAt.After(now) {
+			continue
+		}
+		if !s.runTask(ctx, t, st) {
+			return
+		}
+	}
+}
+
+// runTask runs t while renewing the lease and records the outcome. It
+// returns false if the run was cut short by shutdown or a lost lease, in
+// which case no further tasks should be started.
+func (s *Scheduler) runTask(ctx context.Context, t task, st state) bool {
+	ctx = logging.With(ctx, "task", t.name)
+	runCtx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+	stopRenewing := s.holdLease(runCtx, cancel)
+
+	started := time.Now()
+	s.save(ctx, t.name, map[string]interface{}{
+		"last_started_at": started,
+		"last_status":     "running",
+		"last_worker":     s.workerID,
+		"updated_at":      started,
+	})
+	slog.InfoContext(ctx, "Maintenance task started")
+
+	result, err := t.run(runCtx)
+	stopRenewing()
+	finished := time.Now()
+	duration := finished.Sub(started)
+
+	if errors.Is(context.Cause(runCtx), errLeaseLost) {
+		// The new leader owns the row now; it will rerun the task
+		slog.WarnContext(ctx, "Maintenance task stopped: lease lost", "error", err, "duration", duration)
+		return false
+	}
+
+	fields := map[string]interface{}{
+		"last_finished_at": finished,
+		"last_duration_ms": duration.Milliseconds(),
+		"run_count":        st.RunCount + 1,
+		"updated_at":       finished,
+	}
+	if err != nil {
+		fields["last_status"] = "failed"
+		fields["last_error"] = err.Error()
+		fields["last_result"] = nilIfEmpty(result)
+		metrics.MaintenanceRuns.WithLabelValues(t.name, "failed").Inc()
+		slog.ErrorContext(ctx, "Maintenance task failed", "error", err, "result", result, "duration", duration)
+	} else {
+		fields["last_status"] = "succeeded"
+		fields["last_error"] = nil
+		fields["last_result"] = nilIfEmpty(result)
+		metrics.MaintenanceRuns.WithLabelValues(t.name, "succeeded").Inc()
+		slog.InfoContext(ctx, "Maintenance task finished", "result", result, "duration", duration)
+	}
+	// An interrupted run stays due, so the next leader picks it up
+	interrupted := runCtx.Err() != nil
+	if !interrupted {
+		fields["next_run_at"] = t.schedule.Next(finished)
+	}
+	s.save(context.WithoutCancel(ctx), t.name, fields)
+	return !interrupted
+}
+
+// holdLease renews the lease every checkInterval until the returned stop
+// function is called. If another replica takes the lease, or it can't be
+// renewed before it expires, the task is cancelled.
+func (s *Scheduler) holdLease(ctx context.Context, cancel context.CancelCauseFunc) func() {
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(checkInterval)
+		defer ticker.Stop()
+		renewed := time.Now()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				held, err := s.acquire(ctx)
+				switch {
+				case err != nil && time.Since(renewed) < leaseDuration:
+					slog.WarnContext(ctx, "Maintenance lease renewal failed", "error", err)
+				case err != nil || !held:
+					cancel(errLeaseLost)
+					return
+				default:
+					renewed = time.Now()
+				}
+			}
+		}
+	}()
+	return func() { close(done) }
+}
+
+// save upserts fields into the task's maintenance_runs row.
+func (s *Scheduler) save(ctx context.Context, name string, fields map[string]interface{}) {
+	fields["task"] = name
+	_, _, err := s.client.From("maintenance_runs").Upsert(fields, "task", "minimal", "").Execute()
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to record maintenance state", "task", name, "error", err)
+	}
+}
+
+func nilIfEmpty(s string) interface{} {
+	if s == "" {
+		return nil
+	}
+	return s
+}
@@ -0,0 +1,135 @@
+package maintenance
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/supabase-community/supabase-go"
+	"kai-worker/processor"
+	"kai-worker/rpc"
+)
+
+const (
+	// reembedBatch caps how many documents one run queues jobs for.
+	reembedBatch = 50
+	// reembedPriority keeps maintenance jobs behind uploads (priority 0).
+	reembedPriority = -10
+)
+
+// ReembedMissing queues an only_missing reembed job for every ready document
+// with chunks stored without an embedding. The job loop does the embedding,
+// under the usual API limits, deadlines and retries.
+func ReembedMissing(rpcClient *rpc.Client) TaskFunc {
+	return func(ctx context.Context) (string, error) {
+		var jobs []processor.Job
+		err := rpcClient.Call(ctx, "enqueue_missing_embeddings", map[string]interface{}{
+			"p_limit":    reembedBatch,
+			"p_priority": reembedPriority,
+		}, &jobs)
+		if err != nil {
+			return "", err
+		}
+		for _, j := range jobs {
+			slog.InfoContext(ctx, "Queued reembed job", "job_id", j.ID, "document_id", j.DocumentID)
+		}
+		return fmt.Sprintf("queued %d reembed jobs", len(jobs)), nil
+	}
+}
+
+// embeddingIndex is the ivfflat index created in 005_vector_search.sql.
+const embeddingIndex = "document_chunks_embedding_idx"
+
+// ReindexEmbeddings rebuilds the ivfflat index. ivfflat picks its list
+// centroids when the index is built, so recall drops as chunks are added
+// afterwards. REINDEX CONCURRENTLY keeps search working meanwhile, but can't
+// run inside a transaction, so this needs a direct connection rather than an
+// RPC.
+func ReindexEmbeddings(dsn string) TaskFunc {
+	return func(ctx context.Context) (string, error) {
+		conn, err := pgx.Connect(ctx, dsn)
+		if err != nil {
+			return "", err
+		}
+		defer conn.Close(context.WithoutCancel(ctx))
+
+		start := time.Now()
+		for _, sql := range []string{
+			"set statement_timeout = 0",
+			// An interrupted concurrent reindex leaves an invalid copy behind
+			"drop index concurrently if exists " + pgx.Identifier{embeddingIndex + "_ccnew"}.Sanitize(),
+			"reindex index concurrently " + pgx.Identifier{embeddingIndex}.Sanitize(),
+		} {
+			if _, err := conn.Exec(ctx, sql); err != nil {
+				return "", fmt.Errorf("%s: %w", sql, err)
+			}
+		}
+		return fmt.Sprintf("rebuilt %s in %s", embeddingIndex, time.Since(start).Round(time.Second)), nil
+	}
+}
+
+const (
+	// sweepBatch is how many objects are looked up and removed per call.
+	sweepBatch = 100
+	// sweepMaxPerRun caps one run, so a bad storage_path migration can't
+	// empty the bucket in one go.
+	sweepMaxPerRun = 5000
+)
+
+// SweepOrphans deletes objects in bucket that no document's storage_path
+// points to, once they are older than minAge. Documents deleted through the
+// app remove their file, but failed uploads and deletes leave objects behind.
+// Files under the prefix of a pending ingest_folder job are not orphans yet
+// (see orphaned_storage_objects in migration 019).
+func SweepOrphans(client *supabase.Client, rpcClient *rpc.Client, bucket string, minAge time.Duration) TaskFunc {
+	return func(ctx context.Context) (string, error) {
+		removed := 0
+		summary := func() string { return fmt.Sprintf("removed %d orphaned objects", removed) }
+
+		for removed < sweepMaxPerRun {
+			if err := ctx.Err(); err != nil {
+				return summary(), err
+			}
+
+			var orphans []struct {
+				Name      string    `json:"name"`
+				CreatedAt time.Time `json:"created_at"`
+			}
+			err := rpcClient.Call(ctx, "orphaned_storage_objects", map[string]interface{}{
+				"p_bucket":          bucket,
+				"p_min_age_seconds": int(minAge.Seconds()),
+				"p_limit":           sweepBatch,
+			}, &orphans)
+			if err != nil {
+				return summary(), err
+			}
+			if len(orphans) == 0 {
+				break
+			}
+
+			names := make([]string, len(orphans))
+			for i, o := range orphans {
+				names[i] = o.Name
+			}
+			deleted, err := client.Storage.RemoveFile(bucket, names)
+			if err != nil {
+				return summary(), fmt.Errorf("remove objects: %w", err)
+			}
+			// Nothing removed means nothing will change on the next lookup either
+			if len(deleted) == 0 {
+				return summary(), fmt.Errorf("storage removed none of %d orphaned objects", len(names))
+			}
+			for _, o := range orphans {
+				slog.InfoContext(ctx, "Removed orphaned storage object", "object", o.Name, "created_at", o.CreatedAt)
+			}
+			removed += len(deleted)
+
+			if len(orphans) < sweepBatch {
+				break
+			}
+		}
+		return summary(), nil
+	}
+}
@@ -0,0 +1,92 @@
+// Package metrics holds the worker's Prometheus collectors and the state
+// behind its /healthz endpoint.
+package metrics
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	JobsClaimed = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "kai_worker_jobs_claimed_total",
+		Help: "Jobs claimed from the queue by this worker.",
+	})
+	JobsCompleted = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "kai_worker_jobs_completed_total",
+		Help: "Jobs that finished successfully.",
+	})
+	JobsFailed = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "kai_worker_jobs_failed_total",
+		Help: "Job runs that returned an error, by error kind and resulting status (queued for retry or failed).",
+	}, []string{"kind", "status"})
+	JobsInFlight = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "kai_worker_jobs_in_flight",
+		Help: "Jobs currently being processed by this worker.",
+	})
+
+	PagesProcessed = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "kai_worker_pages_processed_total",
+		Help: "Pages whose text and chunks were stored.",
+	})
+	PagesResumed = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "kai_worker_pages_resumed_total",
+		Help: "Pages skipped on a retry because a previous attempt already completed them.",
+	})
+	OCRFallbacks = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "kai_worker_ocr_fallbacks_total",
+		Help: "Pages sent to Gemini OCR because the text layer was missing, sparse or garbage.",
+	}, []string{"result"})
+	EmbeddingBatchSeconds = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "kai_worker_embedding_batch_seconds",
+		Help:    "Latency of Gemini batch embedding calls.",
+		Buckets: prometheus.ExponentialBuckets(0.1, 2, 10),
+	})
+
+	QueueDepth = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "kai_worker_queue_depth",
+		Help: "Jobs in the queued state, as last sampled.",
+	})
+	LastPollTimestamp = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "kai_worker_last_successful_poll_timestamp_seconds",
+		Help: "Unix time of the last successful job claim call.",
+	})
+
+	MaintenanceRuns = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "kai_worker_maintenance_runs_total",
+		Help: "Maintenance task runs on this worker, by task and result (succeeded or failed).",
+	}, []string{"task", "result"})
+	MaintenanceLeader = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "kai_worker_maintenance_leader",
+		Help: "1 while this worker holds the maintenance lease, 0 otherwise.",
+	})
+)
+
+// lastActivity is the Unix time of the last sign of life from the job loop:
+// a successful poll or a lease heartbeat for a running job.
+var lastActivity atomic.Int64
+
+// PollSucceeded records a successful claim call, whether or not it returned a job.
+func PollSucceeded() {
+	now := time.Now()
+	LastPollTimestamp.Set(float64(now.Unix()))
+	lastActivity.Store(now.Unix())
+}
+
+// Heartbeat records that a running job is still making progress. Slots
+// busy with a long document don't poll, so this keeps /healthz green.
+func Heartbeat() {
+	lastActivity.Store(time.Now().Unix())
+}
+
+// SinceLastActivity is how long the job loop has been silent.
+func SinceLastActivity() time.Duration {
+	last := lastActivity.Load()
+	if last == 0 {
+		return 0
+	}
+	return time.Since(time.Unix(last, 0))
+}
@@ -0,0 +1,94 @@
+// Package notify wakes idle workers when Postgres announces new jobs
+// via LISTEN/NOTIFY, so they don't have to poll PostgREST in a tight loop.
+package notify
+
+import (
+	"context"
+	"log/slog"
+	"sync/atomic"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// Listener holds a dedicated Postgres connection LISTENing on one channel
+// and turns each notification into a wake-up on C.
+type Listener struct {
+	dsn     string
+	channel string
+	wake    chan struct{}
+
+	connected atomic.Bool
+}
+
+// NewListener returns a Listener for channel. buffer is how many pending
+// wake-ups may queue up; one per worker slot is plenty.
+func NewListener(dsn, channel string, buffer int) *Listener {
+	return &Listener{
+		dsn:     dsn,
+		channel: channel,
+		wake:    make(chan struct{}, buffer),
+	}
+}
+
+// C receives a value for every notification (dropped when the buffer is full,
+// since a full buffer already means every idle worker will wake up).
+func (l *Listener) C() <-chan struct{} {
+	return l.wake
+}
+
+// Run listens until ctx is cancelled, reconnecting with backoff whenever the
+// connection drops.
+func (l *Listener) Run(ctx context.Context) {
+	backoff := time.Second
+	for ctx.Err() == nil {
+		err := l.listen(ctx)
+		if l.connected.Swap(false) {
+			backoff = time.Second // we were up; start over
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		slog.WarnContext(ctx, "Job notifications unavailable; polling until reconnected", "error", err, "retry_in", backoff)
+
+		t := time.NewTimer(backoff)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return
+		case <-t.C:
+		}
+		backoff = min(backoff*2, time.Minute)
+	}
+}
+
+func (l *Listener) listen(ctx context.Context) error {
+	conn, err := pgx.Connect(ctx, l.dsn)
+	if err != nil {
+		return err
+	}
+	defer conn.Close(context.WithoutCancel(ctx))
+
+	if _, err := conn.Exec(ctx, "listen "+pgx.Identifier{l.channel}.Sanitize()); err != nil {
+		return err
+	}
+	l.connected.Store(true)
+	slog.InfoContext(ctx, "Listening for job notifications", "channel", l.channel)
+
+	// Jobs may have been queued while we were disconnected
+	l.signal()
+
+	for {
+		if _, err := conn.WaitForNotification(ctx); err != nil {
+			return err
+		}
+		l.signal()
+	}
+}
+
+func (l *Listener) signal() {
+	select {
+	case l.wake <- struct{}{}:
+	default:
+	}
+}
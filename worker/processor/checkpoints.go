@@ -0,0 +1,73 @@
+package processor
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"time"
+)
+
+// PageMethod records how a page's text was obtained, in document_pages.method.
+type PageMethod string
+
+const (
+	MethodTextLayer PageMethod = "text_layer"
+	MethodOCR       PageMethod = "ocr"
+	MethodDocx      PageMethod = "docx"
+	MethodXLSX      PageMethod = "xlsx"
+	MethodPPTX      PageMethod = "pptx"
+	MethodText      PageMethod = "text"
+	MethodMarkdown  PageMethod = "markdown"
+	MethodHTML      PageMethod = "html"
+)
+
+// completedPages returns the pages of a document that an earlier attempt of
+// the same job fully stored and that are still consistent (see
+// completed_pages in migration 016). Those pages are skipped when the job is
+// retried; a new job for the document redoes them all.
+func (p *Processor) completedPages(ctx context.Context, documentID, jobID string) (map[int]bool, error) {
+	var rows []struct {
+		PageNumber int `json:"page_number"`
+	}
+	err := p.rpc.Call(ctx, "completed_pages", map[string]interface{}{
+		"p_document_id": documentID,
+		"p_job_id":      jobID,
+	}, &rows)
+	if err != nil {
+		return nil, err
+	}
+
+	done := make(map[int]bool, len(rows))
+	for _, r := range rows {
+		done[r.PageNumber] = true
+	}
+	return done, nil
+}
+
+// markPageComplete writes the page's checkpoint once its text and chunks are
+// stored, on behalf of st's job. Until then completed_at stays null and a
+// retry redoes the page.
+func (p *Processor) markPageComplete(ctx context.Context, st *stageTracker, documentID string, pageNum int, pageText string, chunkCount int) error {
+	_, _, err := p.client.From("document_pages").
+		Update(map[string]interface{}{
+			"text_hash":    textHash(pageText),
+			"chunk_count":  chunkCount,
+			"completed_at": time.Now(),
+			"job_id":       st.jobID,
+		}, "minimal", "").
+		Eq("document_id", documentID).
+		Eq("page_number", fmt.Sprintf("%d", pageNum)).
+		Execute()
+	if err != nil {
+		return Transient(CodeDatabase, fmt.Errorf("page %d checkpoint failed: %w", pageNum, err))
+	}
+	st.pageCompleted()
+	return nil
+}
+
+// textHash is the hex sha256 of text, matching the check in completed_pages.
+func textHash(text string) string {
+	sum := sha256.Sum256([]byte(text))
+	return hex.EncodeToString(sum[:])
+}
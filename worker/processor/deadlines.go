@@ -0,0 +1,101 @@
+package processor
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// deadline is the cancellation cause of a context bounded by withDeadline,
+// so a timeout can say which limit fired.
+type deadline struct {
+	scope string // "job", "page", "download", "ocr", "embedding"
+	limit time.Duration
+}
+
+func (d *deadline) Error() string {
+	return fmt.Sprintf("%s deadline of %s exceeded", d.scope, d.limit)
+}
+
+// withDeadline bounds ctx by limit, or returns it unbounded if limit is zero.
+func withDeadline(ctx context.Context, scope string, limit time.Duration) (context.Context, context.CancelFunc) {
+	if limit <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeoutCause(ctx, limit, &deadline{scope: scope, limit: limit})
+}
+
+// TimeoutError reports that a job, page or outbound call ran past its
+// deadline, and in which stage. It is always wrapped as a transient error
+// with CodeTimeout, so the job is retried (and resumes from its checkpoints).
+type TimeoutError struct {
+	Scope string
+	Limit time.Duration
+	Stage Stage // empty if the deadline fired between stages
+	Page  int   // 0 for whole-document stages
+	// PagesCompleted is how many pages the run checkpointed before a job
+	// deadline fired; 0 for other scopes.
+	PagesCompleted int
+	Err            error
+}
+
+func (e *TimeoutError) Error() string {
+	msg := fmt.Sprintf("%s deadline of %s exceeded", e.Scope, e.Limit)
+	if e.Stage != "" {
+		msg += fmt.Sprintf(" during %s", e.Stage)
+	}
+	if e.Page > 0 {
+		msg += fmt.Sprintf(" on page %d", e.Page)
+	}
+	if e.PagesCompleted > 0 {
+		msg += fmt.Sprintf(" after completing %d pages", e.PagesCompleted)
+	}
+	return fmt.Sprintf("%s: %v", msg, e.Err)
+}
+
+// MadeProgress reports whether err is a job deadline that fired after the
+// run checkpointed pages. The retry resumes after those pages, so a large
+// document that needs several runs of the job deadline still gets there;
+// such runs don't count against max_attempts.
+func MadeProgress(err error) bool {
+	var terr *TimeoutError
+	return errors.As(err, &terr) && terr.Scope == "job" && terr.PagesCompleted > 0
+}
+
+func (e *TimeoutError) Unwrap() error {
+	return e.Err
+}
+
+// stageKey carries the stage and page set by stageTracker.begin.
+type stageKey struct{}
+
+type stageAt struct {
+	stage Stage
+	page  int
+}
+
+// deadlineError turns err into a retryable timeout naming the stage if one
+// of our deadlines on ctx has passed. Other errors are returned unchanged,
+// as are errors that already are timeouts, so it is safe to apply at every
+// level (call, stage, page, job).
+func deadlineError(ctx context.Context, err error) error {
+	if err == nil || ctx.Err() == nil {
+		return err
+	}
+	var terr *TimeoutError
+	if errors.As(err, &terr) {
+		return err
+	}
+	var d *deadline
+	if !errors.As(context.Cause(ctx), &d) {
+		return err
+	}
+
+	terr = &TimeoutError{Scope: d.scope, Limit: d.limit, Err: err}
+	if at, ok := ctx.Value(stageKey{}).(stageAt); ok {
+		terr.Stage = at.stage
+		terr.Page = at.page
+	}
+	return Transient(CodeTimeout, terr)
+}
@@ -0,0 +1,108 @@
+package processor
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/googleapis/gax-go/v2/apierror"
+	"google.golang.org/grpc/codes"
+)
+
+// ErrorKind tells the worker loop what to do with a failed job.
+type ErrorKind string
+
+const (
+	// KindPermanent errors will fail again on retry (bad file, missing
+	// document); the job goes straight to failed.
+	KindPermanent ErrorKind = "permanent"
+	// KindTransient errors (network, database, Gemini 5xx, timeouts) are retried with backoff.
+	KindTransient ErrorKind = "transient"
+	// KindRateLimited errors are quota/429 responses; retried with a longer backoff.
+	KindRateLimited ErrorKind = "rate_limited"
+)
+
+// Reason codes stored in jobs.error_code. Keep them stable: dashboards and
+// queries group on these strings.
+const (
+	CodeDocumentNotFound = "document_not_found"
+	CodeFileNotFound     = "file_not_found"
+	CodeDownloadFailed   = "download_failed"
+	CodeInvalidPDF       = "invalid_pdf"
+	CodeInvalidDocx      = "invalid_docx"
+	CodeUnsupportedType  = "unsupported_type"
+	CodeInvalidFile      = "invalid_file"
+	CodeGeminiQuota      = "gemini_quota"
+	CodeGeminiError      = "gemini_error"
+	CodeDatabase         = "database_error"
+	CodeUnknownKind      = "unknown_job_kind"
+	CodePageOutOfRange   = "page_out_of_range"
+	CodeTimeout          = "timeout"
+	CodeInvalidParams    = "invalid_params"
+	CodeEmptyFolder      = "empty_folder"
+	CodeUnknown          = "unknown"
+)
+
+// Error is a classified processing failure.
+type Error struct {
+	Kind ErrorKind
+	Code string
+	Err  error
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s: %v", e.Code, e.Err)
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// Permanent wraps err as a failure that retrying will not fix.
+func Permanent(code string, err error) error {
+	return &Error{Kind: KindPermanent, Code: code, Err: err}
+}
+
+// Transient wraps err as a failure worth retrying.
+func Transient(code string, err error) error {
+	return &Error{Kind: KindTransient, Code: code, Err: err}
+}
+
+// RateLimited wraps err as a quota failure that needs a longer pause before retrying.
+func RateLimited(code string, err error) error {
+	return &Error{Kind: KindRateLimited, Code: code, Err: err}
+}
+
+// Classify returns the classified form of err. Errors that were never
+// wrapped are treated as transient with CodeUnknown, which matches the old
+// behaviour of retrying everything.
+func Classify(err error) *Error {
+	var perr *Error
+	if errors.As(err, &perr) {
+		return perr
+	}
+	return &Error{Kind: KindTransient, Code: CodeUnknown, Err: err}
+}
+
+// geminiError classifies an error returned by the Gemini client.
+func geminiError(err error) error {
+	if err == nil || errors.Is(err, context.Canceled) {
+		return err
+	}
+
+	var apiErr *apierror.APIError
+	if errors.As(err, &apiErr) {
+		if apiErr.HTTPCode() == http.StatusTooManyRequests || apiErr.GRPCStatus().Code() == codes.ResourceExhausted {
+			return RateLimited(CodeGeminiQuota, err)
+		}
+		return Transient(CodeGeminiError, err)
+	}
+
+	msg := err.Error()
+	if strings.Contains(msg, "429") || strings.Contains(msg, "RESOURCE_EXHAUSTED") || strings.Contains(strings.ToLower(msg), "quota") {
+		return RateLimited(CodeGeminiQuota, err)
+	}
+	return Transient(CodeGeminiError, err)
+}
@@ -0,0 +1,211 @@
+package processor
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Extractor reads one type of file as a sequence of pages. Which extractor
+// handles a download is decided by sniffing its content (detectType), not
+// by the name it was uploaded under.
+type Extractor interface {
+	// Open readies the file at path. Errors for files that can't be read
+	// should be Permanent: retrying won't fix them.
+	Open(ctx context.Context, path string) (PageSource, error)
+}
+
+// PageSource is an opened file. Pages are numbered from 1 to Count.
+type PageSource interface {
+	Count() int
+	Page(ctx context.Context, n int) (Page, error)
+	Close() error
+}
+
+// Page is the text of one page and what the extractor knows about it.
+type Page struct {
+	Text   string
+	Method PageMethod
+	// Notes is text that belongs to the page without being on it, such as
+	// speaker notes. It is stored after Text and survives OCR replacing Text.
+	Notes string
+	// Metadata is stored in document_pages.metadata, e.g. a sheet or
+	// slide title. May be nil.
+	Metadata map[string]any
+	// OCRFallback marks pages that may be pictures of text (scans,
+	// image-only slides). If their text is missing, sparse or garbled they
+	// are sent to Gemini, provided the source implements ocrSource.
+	OCRFallback bool
+	// OCRRequired marks pages that are pictures with no text of their own
+	// (image files). They always go to OCR, and fail if it does.
+	OCRRequired bool
+}
+
+// content is the text stored and chunked for the page.
+func (pg Page) content() string {
+	if pg.Notes == "" {
+		return pg.Text
+	}
+	return strings.TrimSpace(pg.Text + "\n\nNotes:\n" + pg.Notes)
+}
+
+// ocrSource is implemented by sources that can hand Gemini a page to read.
+type ocrSource interface {
+	// ocrInput returns page n as Gemini should see it.
+	ocrInput(ctx context.Context, n int) (ocrInput, error)
+}
+
+// ocrInput is a file (or part of one) to OCR, e.g. a single-page PDF.
+type ocrInput struct {
+	Data     []byte
+	MIMEType string
+}
+
+// MIME types the worker recognises.
+const (
+	mimePDF  = "application/pdf"
+	mimeDOCX = "application/vnd.openxmlformats-officedocument.wordprocessingml.document"
+	mimeXLSX = "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet"
+	mimePPTX = "application/vnd.openxmlformats-officedocument.presentationml.presentation"
+	mimeZip  = "application/zip"
+
+	mimeText     = "text/plain"
+	mimeMarkdown = "text/markdown"
+	mimeHTML     = "text/html"
+
+	mimeJPEG = "image/jpeg"
+	mimePNG  = "image/png"
+	mimeTIFF = "image/tiff"
+)
+
+// extractors maps sniffed MIME types to the extractor that reads them.
+// Anything else fails the job with CodeUnsupportedType.
+var extractors = map[string]Extractor{
+	mimePDF:  pdfExtractor{},
+	mimeDOCX: docxExtractor{},
+	mimeXLSX: xlsxExtractor{},
+	mimePPTX: pptxExtractor{},
+
+	mimeText:     textExtractor{format: MethodText},
+	mimeMarkdown: textExtractor{format: MethodMarkdown},
+	mimeHTML:     htmlExtractor{},
+
+	mimeJPEG: imageExtractor{mimeType: mimeJPEG},
+	mimePNG:  imageExtractor{mimeType: mimePNG},
+	mimeTIFF: imageExtractor{mimeType: mimeTIFF},
+}
+
+// extensionTypes are the file names folder jobs pick up. Only a hint: the
+// content decides the extractor once the file is downloaded.
+var extensionTypes = map[string]string{
+	".pdf":  mimePDF,
+	".docx": mimeDOCX,
+	".xlsx": mimeXLSX,
+	".pptx": mimePPTX,
+
+	".txt":      mimeText,
+	".md":       mimeMarkdown,
+	".markdown": mimeMarkdown,
+	".html":     mimeHTML,
+	".htm":      mimeHTML,
+
+	".jpg":  mimeJPEG,
+	".jpeg": mimeJPEG,
+	".png":  mimePNG,
+	".tif":  mimeTIFF,
+	".tiff": mimeTIFF,
+}
+
+// extractorFor sniffs the file at path and returns its MIME type and the
+// extractor registered for it.
+func extractorFor(path string) (string, Extractor, error) {
+	mimeType, err := detectType(path)
+	if err != nil {
+		return "", nil, err
+	}
+	e, ok := extractors[mimeType]
+	if !ok {
+		return mimeType, nil, Permanent(CodeUnsupportedType, fmt.Errorf("unsupported file type %s", mimeType))
+	}
+	return mimeType, e, nil
+}
+
+// sniffLen is how much of a file detectType looks at.
+const sniffLen = 1024
+
+// detectType returns the MIME type of the file at path from its magic bytes.
+// Office files are zip archives, told apart by their main part. Text formats
+// have no magic bytes to tell them apart, so for plain text the extension
+// decides between text, Markdown and HTML fragments.
+func detectType(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	head := make([]byte, sniffLen)
+	n, err := io.ReadFull(f, head)
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) && !errors.Is(err, io.EOF) {
+		return "", err
+	}
+	head = head[:n]
+
+	// Magic bytes only count at the start: a text file that mentions
+	// "%PDF-" is still text
+	switch {
+	case bytes.HasPrefix(head, []byte("%PDF-")):
+		return mimePDF, nil
+	case bytes.HasPrefix(head, []byte("PK\x03\x04")):
+		return zipType(path), nil
+	case bytes.HasPrefix(head, []byte("II*\x00")), bytes.HasPrefix(head, []byte("MM\x00*")):
+		return mimeTIFF, nil // not sniffed by net/http
+	}
+
+	// net/http implements the WHATWG sniffing rules; drop the charset. A
+	// UTF-8 BOM would hide an HTML tag from it.
+	mimeType, _, _ := strings.Cut(http.DetectContentType(bytes.TrimPrefix(head, utf8BOM)), ";")
+	if mimeType == mimeText {
+		if hint := extensionTypes[strings.ToLower(filepath.Ext(path))]; hint == mimeMarkdown || hint == mimeHTML {
+			return hint, nil
+		}
+	}
+	return mimeType, nil
+}
+
+var utf8BOM = []byte("\xef\xbb\xbf")
+
+// zipType tells Office Open XML formats apart by the part each one must have.
+func zipType(path string) string {
+	r, err := zip.OpenReader(path)
+	if err != nil {
+		return mimeZip
+	}
+	defer r.Close()
+
+	for _, f := range r.File {
+		switch f.Name {
+		case "word/document.xml":
+			return mimeDOCX
+		case "xl/workbook.xml":
+			return mimeXLSX
+		case "ppt/presentation.xml":
+			return mimePPTX
+		}
+	}
+	return mimeZip
+}
+
+// ingestible reports whether a folder job should pick the file up, judged
+// by its extension.
+func ingestible(name string) bool {
+	_, ok := extensionTypes[strings.ToLower(filepath.Ext(name))]
+	return ok
+}
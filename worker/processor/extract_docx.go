@@ -0,0 +1,39 @@
+package processor
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/nguyenthenguyen/docx"
+)
+
+// docxExtractor reads a Word document as a single page: page breaks are
+// decided at render time, so the file itself has none to split on.
+type docxExtractor struct{}
+
+func (docxExtractor) Open(ctx context.Context, path string) (PageSource, error) {
+	r, err := docx.ReadDocxFile(path)
+	if err != nil {
+		return nil, Permanent(CodeInvalidDocx, fmt.Errorf("failed to read docx: %v", err))
+	}
+	defer r.Close()
+	return pageList{{Text: r.Editable().GetContent(), Method: MethodDocx}}, nil
+}
+
+// pageList is a source whose pages are all read up front.
+type pageList []Page
+
+func (l pageList) Count() int {
+	return len(l)
+}
+
+func (l pageList) Page(ctx context.Context, n int) (Page, error) {
+	if n < 1 || n > len(l) {
+		return Page{}, fmt.Errorf("page %d out of range", n)
+	}
+	return l[n-1], nil
+}
+
+func (l pageList) Close() error {
+	return nil
+}
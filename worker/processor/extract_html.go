@@ -0,0 +1,346 @@
+package processor
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+// htmlExtractor reads a saved web page. Only the content is kept: scripts,
+// styles, navigation, site headers and footers, sidebars and forms are
+// dropped, and so is everything outside <main> (or a lone <article>) when
+// the page has one. Headings become Markdown headings, so the text splits
+// into pages like a Markdown file; the <title> goes in every page's metadata.
+type htmlExtractor struct{}
+
+func (htmlExtractor) Open(ctx context.Context, path string) (PageSource, error) {
+	text, err := readText(path, mimeHTML)
+	if err != nil {
+		return nil, Permanent(CodeInvalidFile, fmt.Errorf("failed to read html: %v", err))
+	}
+	doc, err := html.Parse(strings.NewReader(text))
+	if err != nil {
+		return nil, Permanent(CodeInvalidFile, fmt.Errorf("failed to parse html: %v", err))
+	}
+
+	var meta map[string]any
+	if title := collapse(textContent(find(doc, atom.Title))); title != "" {
+		meta = map[string]any{"title": title}
+	}
+	w := &htmlWriter{}
+	w.walk(contentRoot(doc))
+	return textPages(w.b.String(), markdownHeading, MethodHTML, meta)
+}
+
+// boilerplate elements are never content.
+var boilerplate = map[atom.Atom]bool{
+	atom.Head: true, atom.Script: true, atom.Style: true, atom.Noscript: true,
+	atom.Template: true, atom.Svg: true, atom.Iframe: true, atom.Object: true,
+	atom.Canvas: true, atom.Nav: true, atom.Aside: true, atom.Form: true,
+	atom.Button: true, atom.Select: true, atom.Textarea: true, atom.Dialog: true,
+}
+
+// boilerplateRoles are ARIA landmarks for the same.
+var boilerplateRoles = map[string]bool{
+	"navigation": true, "banner": true, "contentinfo": true,
+	"complementary": true, "search": true,
+}
+
+// blockGaps are the newlines around block elements: a blank line around
+// paragraph-like ones, a line break around the rest.
+var blockGaps = map[atom.Atom]int{
+	atom.P: 2, atom.Blockquote: 2, atom.Ul: 2, atom.Ol: 2, atom.Dl: 2,
+	atom.Section: 2, atom.Article: 2, atom.Main: 2, atom.Figure: 2,
+	atom.Table: 2, atom.Hr: 2, atom.Address: 2, atom.Details: 2,
+	atom.Div: 1, atom.Dt: 1, atom.Dd: 1, atom.Figcaption: 1, atom.Caption: 1,
+	atom.Tr: 1, atom.Center: 1, atom.Summary: 1, atom.Fieldset: 1,
+}
+
+var headingLevels = map[atom.Atom]int{
+	atom.H1: 1, atom.H2: 2, atom.H3: 3, atom.H4: 4, atom.H5: 5, atom.H6: 6,
+}
+
+// isBoilerplate reports whether n is left out of the text. Headers and
+// footers only are when they belong to the page rather than to an article
+// or section within it.
+func isBoilerplate(n *html.Node) bool {
+	if n.Type != html.ElementNode {
+		return false
+	}
+	if boilerplate[n.DataAtom] || boilerplateRoles[getAttr(n, "role")] {
+		return true
+	}
+	if _, ok := getAttrOK(n, "hidden"); ok || getAttr(n, "aria-hidden") == "true" {
+		return true
+	}
+	if strings.Contains(strings.ReplaceAll(getAttr(n, "style"), " ", ""), "display:none") {
+		return true
+	}
+	if n.DataAtom == atom.Header || n.DataAtom == atom.Footer {
+		for p := n.Parent; p != nil; p = p.Parent {
+			switch p.DataAtom {
+			case atom.Article, atom.Section, atom.Main:
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// contentRoot returns the element holding the page's content: <main>, else
+// the only <article>, else <body>.
+func contentRoot(doc *html.Node) *html.Node {
+	var mains, articles []*html.Node
+	var visit func(*html.Node)
+	visit = func(n *html.Node) {
+		if isBoilerplate(n) {
+			return
+		}
+		if n.Type == html.ElementNode {
+			switch {
+			case n.DataAtom == atom.Main || getAttr(n, "role") == "main":
+				mains = append(mains, n)
+			case n.DataAtom == atom.Article:
+				articles = append(articles, n)
+			}
+		}
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			visit(c)
+		}
+	}
+	visit(doc)
+
+	switch {
+	case len(mains) > 0:
+		return mains[0]
+	case len(articles) == 1:
+		return articles[0]
+	}
+	if body := find(doc, atom.Body); body != nil {
+		return body
+	}
+	return doc
+}
+
+// htmlWriter renders the content of a page as text with Markdown headings
+// and lists, collapsing whitespace the way a browser does.
+type htmlWriter struct {
+	b        strings.Builder
+	last     rune // last rune written, 0 at the start
+	newlines int  // newlines at the end of the output
+	space    bool // whitespace pending before the next word
+	pre      int  // depth of <pre> elements
+}
+
+func (w *htmlWriter) walk(n *html.Node) {
+	switch n.Type {
+	case html.TextNode:
+		if w.pre > 0 {
+			w.write(n.Data)
+		} else {
+			w.text(n.Data)
+		}
+		return
+	case html.ElementNode:
+		if isBoilerplate(n) {
+			return
+		}
+		if level, ok := headingLevels[n.DataAtom]; ok {
+			if title := collapse(textContent(n)); title != "" {
+				w.lineBreak(2)
+				w.write(strings.Repeat("#", level) + " " + title)
+				w.lineBreak(2)
+			}
+			return
+		}
+		switch n.DataAtom {
+		case atom.Br:
+			w.write("\n")
+			return
+		case atom.Li:
+			w.lineBreak(1)
+			w.write("- ")
+			w.children(n)
+			w.lineBreak(1)
+			return
+		case atom.Pre:
+			w.lineBreak(2)
+			w.pre++
+			w.children(n)
+			w.pre--
+			w.lineBreak(2)
+			return
+		case atom.Table:
+			if rows, ok := dataTable(n); ok {
+				w.lineBreak(2)
+				for _, line := range labelRows(rows) {
+					w.write(line)
+					w.lineBreak(1)
+				}
+				w.lineBreak(2)
+				return
+			}
+		}
+		if gap, ok := blockGaps[n.DataAtom]; ok {
+			w.lineBreak(gap)
+			w.children(n)
+			w.lineBreak(gap)
+			return
+		}
+	}
+	w.children(n)
+}
+
+func (w *htmlWriter) children(n *html.Node) {
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		w.walk(c)
+	}
+}
+
+// text writes inline text with runs of whitespace collapsed to one space,
+// and none at the start of a line.
+func (w *htmlWriter) text(s string) {
+	words := strings.Fields(s)
+	if len(words) == 0 {
+		w.space = w.space || s != ""
+		return
+	}
+	if first, _ := utf8.DecodeRuneInString(s); unicode.IsSpace(first) {
+		w.space = true
+	}
+	if w.space && w.last != 0 && w.last != ' ' && w.last != '\n' {
+		w.write(" ")
+	}
+	w.write(strings.Join(words, " "))
+	last, _ := utf8.DecodeLastRuneInString(s)
+	w.space = unicode.IsSpace(last)
+}
+
+// write writes s as it is.
+func (w *htmlWriter) write(s string) {
+	if s == "" {
+		return
+	}
+	w.b.WriteString(s)
+	trimmed := strings.TrimRight(s, "\n")
+	if trimmed == "" {
+		w.newlines += len(s)
+	} else {
+		w.newlines = len(s) - len(trimmed)
+	}
+	w.last = rune(s[len(s)-1])
+	w.space = false
+}
+
+// lineBreak ends the current line, leaving n newlines (2 for a blank line)
+// unless there already are that many. Nothing is written at the start.
+func (w *htmlWriter) lineBreak(n int) {
+	if w.last == 0 {
+		return
+	}
+	for w.newlines < n {
+		w.write("\n")
+	}
+}
+
+// dataTable returns the rows of a table holding data. Tables used for page
+// layout, which nest other tables or have a single column, are not data
+// tables and are rendered like any other block.
+func dataTable(table *html.Node) ([][]string, bool) {
+	for c := table.FirstChild; c != nil; c = c.NextSibling {
+		if find(c, atom.Table) != nil {
+			return nil, false
+		}
+	}
+
+	var rows [][]string
+	width := 0
+	var visit func(*html.Node)
+	visit = func(n *html.Node) {
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			if c.Type != html.ElementNode || isBoilerplate(c) {
+				continue
+			}
+			if c.DataAtom != atom.Tr {
+				visit(c)
+				continue
+			}
+			var row []string
+			for cell := c.FirstChild; cell != nil; cell = cell.NextSibling {
+				if cell.DataAtom == atom.Td || cell.DataAtom == atom.Th {
+					row = append(row, collapse(textContent(cell)))
+				}
+			}
+			if countValues(row) > 0 {
+				rows = append(rows, row)
+				width = max(width, len(row))
+			}
+		}
+	}
+	visit(table)
+	return rows, width >= 2
+}
+
+// textContent returns the text under n, outside boilerplate, with a space
+// between blocks.
+func textContent(n *html.Node) string {
+	if n == nil {
+		return ""
+	}
+	var b strings.Builder
+	var visit func(*html.Node)
+	visit = func(n *html.Node) {
+		switch {
+		case n.Type == html.TextNode:
+			b.WriteString(n.Data)
+			return
+		case isBoilerplate(n):
+			return
+		case n.DataAtom == atom.Br || blockGaps[n.DataAtom] > 0:
+			b.WriteString(" ")
+		}
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			visit(c)
+		}
+	}
+	visit(n)
+	return b.String()
+}
+
+// find returns the first element of type a under n, or nil.
+func find(n *html.Node, a atom.Atom) *html.Node {
+	if n.Type == html.ElementNode && n.DataAtom == a {
+		return n
+	}
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		if found := find(c, a); found != nil {
+			return found
+		}
+	}
+	return nil
+}
+
+func getAttr(n *html.Node, key string) string {
+	v, _ := getAttrOK(n, key)
+	return v
+}
+
+func getAttrOK(n *html.Node, key string) (string, bool) {
+	for _, a := range n.Attr {
+		if a.Namespace == "" && a.Key == key {
+			return a.Val, true
+		}
+	}
+	return "", false
+}
+
+// collapse joins the words of s with single spaces.
+func collapse(s string) string {
+	return strings.Join(strings.Fields(s), " ")
+}
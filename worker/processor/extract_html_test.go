@@ -0,0 +1,78 @@
+package processor
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestHTMLExtractor(t *testing.T) {
+	page := `<!DOCTYPE html>
+<html>
+<head><title>Surat Edaran 12/2024</title><style>p { color: red }</style></head>
+<body>
+<header><a href="/">Home</a> | <a href="/about">About</a></header>
+<nav><ul><li>Menu</li></ul></nav>
+<main>
+  <h1>Surat   Edaran</h1>
+  <p>Berlaku   mulai
+  1 Januari.</p>
+  <div hidden>Hidden text</div>
+  <h2>Ketentuan</h2>
+  <ul><li>Satu</li><li>Dua</li></ul>
+  <table>
+    <tr><th>Kode</th><th>Tarif</th></tr>
+    <tr><td>A</td><td>10%</td></tr>
+  </table>
+  <script>track()</script>
+</main>
+<aside>Related links</aside>
+<footer>Copyright</footer>
+</body>
+</html>`
+
+	pages := readPages(t, htmlExtractor{}, writeFile(t, "page.html", []byte(page)))
+	if len(pages) != 1 {
+		t.Fatalf("got %d pages, want 1", len(pages))
+	}
+	got := pages[0]
+
+	// Content only: no site header, menu, hidden text, script or footer
+	want := "# Surat Edaran\n\nBerlaku mulai 1 Januari.\n\n## Ketentuan\n\n- Satu\n- Dua\n\n" +
+		"Columns: Kode | Tarif\nKode: A | Tarif: 10%"
+	if got.Text != want {
+		t.Errorf("text = %q, want %q", got.Text, want)
+	}
+	if got.Method != MethodHTML {
+		t.Errorf("method = %s, want %s", got.Method, MethodHTML)
+	}
+	if title := got.Metadata["title"]; title != "Surat Edaran 12/2024" {
+		t.Errorf("title = %v, want Surat Edaran 12/2024", title)
+	}
+	if heading := got.Metadata["heading"]; heading != "Surat Edaran" {
+		t.Errorf("heading = %v, want Surat Edaran", heading)
+	}
+	if headings, _ := got.Metadata["headings"].([]string); !slices.Equal(headings, []string{"Surat Edaran", "Ketentuan"}) {
+		t.Errorf("headings = %v, want [Surat Edaran Ketentuan]", got.Metadata["headings"])
+	}
+}
+
+// Without <main>, a lone <article> is the content; layout tables are
+// rendered as text rather than as data.
+func TestHTMLExtractorArticle(t *testing.T) {
+	page := `<html><body>
+<div class="sidebar" role="navigation">Links</div>
+<article>
+  <header><h1>Judul</h1></header>
+  <table><tr><td><p>Isi dalam tabel tata letak.</p></td></tr></table>
+</article>
+<div>Outside the article</div>
+</body></html>`
+
+	pages := readPages(t, htmlExtractor{}, writeFile(t, "page.html", []byte(page)))
+	if len(pages) != 1 {
+		t.Fatalf("got %d pages, want 1", len(pages))
+	}
+	if want := "# Judul\n\nIsi dalam tabel tata letak."; pages[0].Text != want {
+		t.Errorf("text = %q, want %q", pages[0].Text, want)
+	}
+}
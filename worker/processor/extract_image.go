@@ -0,0 +1,136 @@
+package processor
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image/png"
+	"os"
+
+	"golang.org/x/image/tiff"
+)
+
+// imageExtractor reads a photo or scan of printed text. The image, or each
+// frame of a multi-page TIFF, is a page whose text comes from Gemini OCR.
+// JPEG and PNG are sent as they are; Gemini doesn't take TIFF, so each
+// frame is converted to PNG.
+type imageExtractor struct {
+	mimeType string
+}
+
+func (e imageExtractor) Open(ctx context.Context, path string) (PageSource, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	src := &imageSource{data: data, mimeType: e.mimeType}
+	if e.mimeType == mimeTIFF {
+		if src.frames, err = tiffFrames(data); err != nil {
+			return nil, Permanent(CodeInvalidFile, fmt.Errorf("failed to read tiff: %v", err))
+		}
+	}
+	return src, nil
+}
+
+type imageSource struct {
+	data     []byte
+	mimeType string
+	frames   []uint32 // TIFF only: offset of each frame's IFD
+}
+
+func (s *imageSource) Count() int {
+	if s.mimeType == mimeTIFF {
+		return len(s.frames)
+	}
+	return 1
+}
+
+// Page has no text: it is all in the picture, so OCR is required.
+func (s *imageSource) Page(ctx context.Context, n int) (Page, error) {
+	if n < 1 || n > s.Count() {
+		return Page{}, fmt.Errorf("page %d out of range", n)
+	}
+	var meta map[string]any
+	if s.mimeType == mimeTIFF {
+		meta = map[string]any{"frame": n}
+	}
+	return Page{Method: MethodOCR, Metadata: meta, OCRRequired: true}, nil
+}
+
+func (s *imageSource) Close() error {
+	return nil
+}
+
+// ocrInput returns the image itself, or frame n of a TIFF as PNG.
+func (s *imageSource) ocrInput(ctx context.Context, n int) (ocrInput, error) {
+	if n < 1 || n > s.Count() {
+		return ocrInput{}, fmt.Errorf("page %d out of range", n)
+	}
+	if s.mimeType != mimeTIFF {
+		return ocrInput{Data: s.data, MIMEType: s.mimeType}, nil
+	}
+
+	// The tiff package only decodes the first frame, so hand it a copy of
+	// the file whose header points at frame n instead. Every other offset
+	// in the file is absolute and still holds.
+	data := bytes.Clone(s.data)
+	tiffOrder(data).PutUint32(data[4:8], s.frames[n-1])
+	img, err := tiff.Decode(bytes.NewReader(data))
+	if err != nil {
+		return ocrInput{}, Permanent(CodeInvalidFile, fmt.Errorf("tiff frame %d: %v", n, err))
+	}
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		return ocrInput{}, fmt.Errorf("tiff frame %d: %w", n, err)
+	}
+	return ocrInput{Data: buf.Bytes(), MIMEType: "image/png"}, nil
+}
+
+// tiffFrames follows the chain of image file directories (IFDs) in a TIFF
+// file and returns their offsets, one per frame.
+func tiffFrames(data []byte) ([]uint32, error) {
+	if len(data) < 8 {
+		return nil, errors.New("file too short")
+	}
+	order := tiffOrder(data)
+	if order == nil || order.Uint16(data[2:4]) != 42 {
+		return nil, errors.New("not a classic TIFF file") // BigTIFF is 43
+	}
+
+	var frames []uint32
+	seen := map[uint32]bool{}
+	for offset := order.Uint32(data[4:8]); offset != 0; {
+		if seen[offset] {
+			return nil, errors.New("IFD chain loops")
+		}
+		seen[offset] = true
+		if uint64(offset)+2 > uint64(len(data)) {
+			return nil, fmt.Errorf("IFD at %d is past the end of the file", offset)
+		}
+		entries := uint64(order.Uint16(data[offset:]))
+		next := uint64(offset) + 2 + 12*entries
+		if next+4 > uint64(len(data)) {
+			return nil, fmt.Errorf("IFD at %d is past the end of the file", offset)
+		}
+		frames = append(frames, offset)
+		offset = order.Uint32(data[next:])
+	}
+	if len(frames) == 0 {
+		return nil, errors.New("no images")
+	}
+	return frames, nil
+}
+
+// tiffOrder returns the byte order a TIFF header declares, or nil.
+func tiffOrder(data []byte) binary.ByteOrder {
+	switch string(data[:2]) {
+	case "II":
+		return binary.LittleEndian
+	case "MM":
+		return binary.BigEndian
+	}
+	return nil
+}
@@ -0,0 +1,134 @@
+package processor
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"image/png"
+	"testing"
+)
+
+// grayTIFF builds a little-endian TIFF with one uncompressed 2x2 grey frame
+// per value, every pixel of frame i set to shades[i].
+func grayTIFF(shades ...byte) []byte {
+	const w, h = 2, 2
+	le := binary.LittleEndian
+	buf := []byte("II\x2a\x00\x00\x00\x00\x00")
+	link := 4 // where the offset of the next IFD goes
+
+	for _, shade := range shades {
+		pixels := len(buf)
+		buf = append(buf, bytes.Repeat([]byte{shade}, w*h)...)
+
+		le.PutUint32(buf[link:], uint32(len(buf)))
+		entries := []struct {
+			tag, typ uint16
+			value    uint32
+		}{
+			{256, 3, w},              // ImageWidth
+			{257, 3, h},              // ImageLength
+			{258, 3, 8},              // BitsPerSample
+			{259, 3, 1},              // Compression: none
+			{262, 3, 1},              // PhotometricInterpretation: black is zero
+			{273, 4, uint32(pixels)}, // StripOffsets
+			{277, 3, 1},              // SamplesPerPixel
+			{278, 3, h},              // RowsPerStrip
+			{279, 4, w * h},          // StripByteCounts
+		}
+		buf = le.AppendUint16(buf, uint16(len(entries)))
+		for _, e := range entries {
+			buf = le.AppendUint16(buf, e.tag)
+			buf = le.AppendUint16(buf, e.typ)
+			buf = le.AppendUint32(buf, 1)
+			buf = le.AppendUint32(buf, e.value)
+		}
+		link = len(buf)
+		buf = le.AppendUint32(buf, 0)
+	}
+	return buf
+}
+
+func TestImageExtractorTIFF(t *testing.T) {
+	ctx := context.Background()
+	shades := []byte{0x10, 0x80, 0xf0}
+	path := writeFile(t, "scan.tif", grayTIFF(shades...))
+
+	pages := readPages(t, imageExtractor{mimeType: mimeTIFF}, path)
+	if len(pages) != len(shades) {
+		t.Fatalf("got %d pages, want one per frame", len(pages))
+	}
+	for i, page := range pages {
+		if !page.OCRRequired || page.Method != MethodOCR || page.Metadata["frame"] != i+1 {
+			t.Errorf("page %d = %+v, want an OCR page for frame %d", i+1, page, i+1)
+		}
+	}
+
+	src, err := imageExtractor{mimeType: mimeTIFF}.Open(ctx, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer src.Close()
+	for i, shade := range shades {
+		in, err := src.(ocrSource).ocrInput(ctx, i+1)
+		if err != nil {
+			t.Fatalf("frame %d: %v", i+1, err)
+		}
+		if in.MIMEType != "image/png" {
+			t.Errorf("frame %d sent as %s, want image/png", i+1, in.MIMEType)
+		}
+		img, err := png.Decode(bytes.NewReader(in.Data))
+		if err != nil {
+			t.Fatalf("frame %d: %v", i+1, err)
+		}
+		if got := color.GrayModel.Convert(img.At(1, 1)).(color.Gray).Y; got != shade {
+			t.Errorf("frame %d pixel = %#x, want %#x", i+1, got, shade)
+		}
+	}
+}
+
+func TestImageExtractorPNG(t *testing.T) {
+	var buf bytes.Buffer
+	png.Encode(&buf, image.NewGray(image.Rect(0, 0, 1, 1)))
+	path := writeFile(t, "photo.png", buf.Bytes())
+
+	src, err := imageExtractor{mimeType: mimePNG}.Open(context.Background(), path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer src.Close()
+	if src.Count() != 1 {
+		t.Fatalf("got %d pages, want 1", src.Count())
+	}
+	in, err := src.(ocrSource).ocrInput(context.Background(), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(in.Data, buf.Bytes()) || in.MIMEType != mimePNG {
+		t.Errorf("ocr input is not the file as it is")
+	}
+}
+
+func TestTIFFFramesInvalid(t *testing.T) {
+	looped := grayTIFF(0x10)
+	copy(looped[len(looped)-4:], looped[4:8]) // the next IFD is the first again
+
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"too short", []byte("II*\x00")},
+		{"bigtiff", []byte("II\x2b\x00\x08\x00\x00\x00")},
+		{"ifd past the end", []byte("II\x2a\x00\xff\x00\x00\x00")},
+		{"ifd loop", looped},
+		{"no frames", []byte("II\x2a\x00\x00\x00\x00\x00")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if frames, err := tiffFrames(tt.data); err == nil {
+				t.Fatalf("tiffFrames = %v, want an error", frames)
+			}
+		})
+	}
+}
@@ -0,0 +1,77 @@
+package processor
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+
+	"github.com/ledongthuc/pdf"
+	"github.com/pdfcpu/pdfcpu/pkg/api"
+	"github.com/pdfcpu/pdfcpu/pkg/pdfcpu/model"
+)
+
+// pdfExtractor reads the PDF text layer page by page. Pages without a
+// usable text layer (scans) are OCR'd one page at a time.
+type pdfExtractor struct{}
+
+func (pdfExtractor) Open(ctx context.Context, path string) (PageSource, error) {
+	f, r, err := pdf.Open(path)
+	if err != nil {
+		return nil, Permanent(CodeInvalidPDF, fmt.Errorf("invalid pdf: %v", err))
+	}
+	return &pdfSource{path: path, file: f, reader: r}, nil
+}
+
+type pdfSource struct {
+	path   string
+	file   *os.File
+	reader *pdf.Reader
+}
+
+func (s *pdfSource) Count() int {
+	return s.reader.NumPage()
+}
+
+// Page returns the page's text layer. A text layer that can't be read is
+// logged and treated as empty, so the page goes to OCR instead.
+func (s *pdfSource) Page(ctx context.Context, n int) (Page, error) {
+	if n < 1 || n > s.reader.NumPage() {
+		return Page{}, fmt.Errorf("page %d out of range", n)
+	}
+	text, err := s.reader.Page(n).GetPlainText(nil)
+	if err != nil {
+		slog.WarnContext(ctx, "text layer extraction failed", "error", err)
+		text = ""
+	}
+	return Page{Text: text, Method: MethodTextLayer, OCRFallback: true}, nil
+}
+
+func (s *pdfSource) Close() error {
+	return s.file.Close()
+}
+
+// ocrInput cuts page n out into a single-page PDF for Gemini.
+func (s *pdfSource) ocrInput(ctx context.Context, n int) (ocrInput, error) {
+	dir, err := os.MkdirTemp("", fmt.Sprintf("gemini_ocr_page_%d_", n))
+	if err != nil {
+		return ocrInput{}, err
+	}
+	defer os.RemoveAll(dir)
+
+	conf := model.NewDefaultConfiguration()
+	if err := api.ExtractPagesFile(s.path, dir, []string{fmt.Sprintf("%d", n)}, conf); err != nil {
+		return ocrInput{}, fmt.Errorf("failed to extract page %d: %w", n, err)
+	}
+
+	files, _ := os.ReadDir(dir)
+	if len(files) == 0 {
+		return ocrInput{}, fmt.Errorf("no page file extracted")
+	}
+	data, err := os.ReadFile(filepath.Join(dir, files[0].Name()))
+	if err != nil {
+		return ocrInput{}, err
+	}
+	return ocrInput{Data: data, MIMEType: mimePDF}, nil
+}
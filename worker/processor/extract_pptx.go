@@ -0,0 +1,428 @@
+package processor
+
+import (
+	"archive/zip"
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+)
+
+// pptxExtractor reads a slide deck with one page per slide, in presentation
+// order: the title, body text and tables on the slide, plus its speaker
+// notes. Slides with pictures but no text (scanned handouts, screenshots)
+// are OCR'd from their largest picture.
+type pptxExtractor struct{}
+
+// Relationship types used to find slides and their notes.
+const (
+	relSlide      = "http://schemas.openxmlformats.org/officeDocument/2006/relationships/slide"
+	relNotesSlide = "http://schemas.openxmlformats.org/officeDocument/2006/relationships/notesSlide"
+	nsRelations   = "http://schemas.openxmlformats.org/officeDocument/2006/relationships"
+)
+
+func (pptxExtractor) Open(ctx context.Context, filePath string) (PageSource, error) {
+	r, err := zip.OpenReader(filePath)
+	if err != nil {
+		return nil, Permanent(CodeInvalidFile, fmt.Errorf("failed to read pptx: %v", err))
+	}
+	src := &pptxSource{zip: r, parts: map[string]*zip.File{}}
+	for _, f := range r.File {
+		src.parts[f.Name] = f
+	}
+
+	if err := src.loadSlides(); err != nil {
+		r.Close()
+		return nil, Permanent(CodeInvalidFile, fmt.Errorf("failed to read pptx: %v", err))
+	}
+	return src, nil
+}
+
+type pptxSource struct {
+	zip    *zip.ReadCloser
+	parts  map[string]*zip.File
+	slides []string // slide part names, in presentation order
+}
+
+// loadSlides lists the slides in the order presentation.xml gives them,
+// which need not match their file names.
+func (s *pptxSource) loadSlides() error {
+	var pres struct {
+		SlideIDs []struct {
+			RID string `xml:"http://schemas.openxmlformats.org/officeDocument/2006/relationships id,attr"`
+		} `xml:"sldIdLst>sldId"`
+	}
+	if err := s.decode("ppt/presentation.xml", &pres); err != nil {
+		return err
+	}
+	rels, err := s.rels("ppt/presentation.xml")
+	if err != nil {
+		return err
+	}
+	for _, id := range pres.SlideIDs {
+		if rel, ok := rels[id.RID]; ok && rel.Type == relSlide {
+			s.slides = append(s.slides, rel.Target)
+		}
+	}
+	return nil
+}
+
+func (s *pptxSource) Count() int {
+	return len(s.slides)
+}
+
+func (s *pptxSource) Page(ctx context.Context, n int) (Page, error) {
+	if n < 1 || n > len(s.slides) {
+		return Page{}, fmt.Errorf("slide %d out of range", n)
+	}
+	slide, rels, err := s.slide(n)
+	if err != nil {
+		return Page{}, err
+	}
+
+	var notes string
+	for _, rel := range rels {
+		if rel.Type != relNotesSlide {
+			continue
+		}
+		f, ok := s.parts[rel.Target]
+		if !ok {
+			break
+		}
+		rc, err := f.Open()
+		if err != nil {
+			return Page{}, Permanent(CodeInvalidFile, fmt.Errorf("slide %d notes: %v", n, err))
+		}
+		parsed, err := parseSlideXML(rc)
+		rc.Close()
+		if err != nil {
+			return Page{}, Permanent(CodeInvalidFile, fmt.Errorf("slide %d notes: %v", n, err))
+		}
+		notes = strings.Join(parsed.body, "\n")
+		break
+	}
+
+	title := strings.Join(slide.title, " ")
+	page := Page{
+		Text:   slide.render(n),
+		Method: MethodPPTX,
+		Notes:  notes,
+		Metadata: map[string]any{
+			"slide":  n,
+			"title":  title,
+			"hidden": slide.hidden,
+		},
+	}
+	// Nothing to read on the slide itself, but maybe in its pictures
+	if page.Text == "" {
+		_, ok := s.largestImage(slide, rels)
+		page.OCRFallback = ok
+	}
+	return page, nil
+}
+
+func (s *pptxSource) Close() error {
+	return s.zip.Close()
+}
+
+// ocrInput returns the slide's largest picture Gemini can read.
+func (s *pptxSource) ocrInput(ctx context.Context, n int) (ocrInput, error) {
+	if n < 1 || n > len(s.slides) {
+		return ocrInput{}, fmt.Errorf("slide %d out of range", n)
+	}
+	slide, rels, err := s.slide(n)
+	if err != nil {
+		return ocrInput{}, err
+	}
+	f, ok := s.largestImage(slide, rels)
+	if !ok {
+		return ocrInput{}, fmt.Errorf("slide %d has no picture to OCR", n)
+	}
+
+	rc, err := f.Open()
+	if err != nil {
+		return ocrInput{}, err
+	}
+	defer rc.Close()
+	data, err := io.ReadAll(rc)
+	if err != nil {
+		return ocrInput{}, err
+	}
+	return ocrInput{Data: data, MIMEType: ocrImageTypes[strings.ToLower(path.Ext(f.Name))]}, nil
+}
+
+// ocrImageTypes are the picture formats Gemini accepts, by extension.
+// Vector formats (EMF, WMF) and TIFF are skipped.
+var ocrImageTypes = map[string]string{
+	".png":  "image/png",
+	".jpg":  "image/jpeg",
+	".jpeg": "image/jpeg",
+	".webp": "image/webp",
+}
+
+// largestImage picks the biggest picture on the slide in a format Gemini
+// reads; on a scanned slide that is the scan.
+func (s *pptxSource) largestImage(slide *slideText, rels map[string]pptxRel) (*zip.File, bool) {
+	var best *zip.File
+	for _, id := range slide.images {
+		rel, ok := rels[id]
+		if !ok {
+			continue
+		}
+		f, ok := s.parts[rel.Target]
+		if !ok {
+			continue
+		}
+		if _, ok := ocrImageTypes[strings.ToLower(path.Ext(f.Name))]; !ok {
+			continue
+		}
+		if best == nil || f.UncompressedSize64 > best.UncompressedSize64 {
+			best = f
+		}
+	}
+	return best, best != nil
+}
+
+// slide parses slide n and its relationships.
+func (s *pptxSource) slide(n int) (*slideText, map[string]pptxRel, error) {
+	name := s.slides[n-1]
+	f, ok := s.parts[name]
+	if !ok {
+		return nil, nil, Permanent(CodeInvalidFile, fmt.Errorf("slide %d: missing part %s", n, name))
+	}
+	rc, err := f.Open()
+	if err != nil {
+		return nil, nil, Permanent(CodeInvalidFile, fmt.Errorf("slide %d: %v", n, err))
+	}
+	defer rc.Close()
+	slide, err := parseSlideXML(rc)
+	if err != nil {
+		return nil, nil, Permanent(CodeInvalidFile, fmt.Errorf("slide %d: %v", n, err))
+	}
+	rels, err := s.rels(name)
+	if err != nil {
+		return nil, nil, Permanent(CodeInvalidFile, fmt.Errorf("slide %d: %v", n, err))
+	}
+	return slide, rels, nil
+}
+
+type pptxRel struct {
+	Type   string
+	Target string // part name, resolved against the source part
+}
+
+// rels reads the relationships of part, e.g. ppt/slides/_rels/slide1.xml.rels
+// for ppt/slides/slide1.xml. A part without relationships has none.
+func (s *pptxSource) rels(part string) (map[string]pptxRel, error) {
+	name := path.Join(path.Dir(part), "_rels", path.Base(part)+".rels")
+	if _, ok := s.parts[name]; !ok {
+		return nil, nil
+	}
+	var doc struct {
+		Rels []struct {
+			ID         string `xml:"Id,attr"`
+			Type       string `xml:"Type,attr"`
+			Target     string `xml:"Target,attr"`
+			TargetMode string `xml:"TargetMode,attr"`
+		} `xml:"Relationship"`
+	}
+	if err := s.decode(name, &doc); err != nil {
+		return nil, err
+	}
+
+	rels := make(map[string]pptxRel, len(doc.Rels))
+	for _, r := range doc.Rels {
+		if r.TargetMode == "External" {
+			continue
+		}
+		target := path.Join(path.Dir(part), r.Target)
+		if strings.HasPrefix(r.Target, "/") {
+			target = strings.TrimPrefix(r.Target, "/")
+		}
+		rels[r.ID] = pptxRel{Type: r.Type, Target: target}
+	}
+	return rels, nil
+}
+
+func (s *pptxSource) decode(name string, v any) error {
+	f, ok := s.parts[name]
+	if !ok {
+		return fmt.Errorf("missing part %s", name)
+	}
+	rc, err := f.Open()
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	return xml.NewDecoder(rc).Decode(v)
+}
+
+// slideText is the text found on a slide (or notes page), by role.
+type slideText struct {
+	title  []string
+	body   []string
+	tables [][][]string
+	images []string // relationship IDs of pictures
+	hidden bool
+}
+
+// render lays the slide out as page text: title, body paragraphs, then
+// tables with each row labelled by the header row. Empty if the slide has
+// no text at all.
+func (t *slideText) render(n int) string {
+	var b strings.Builder
+	for _, line := range t.body {
+		b.WriteString(line + "\n")
+	}
+	for _, table := range t.tables {
+		for _, line := range labelRows(table) {
+			b.WriteString(line + "\n")
+		}
+	}
+	title := strings.Join(t.title, " ")
+	if title == "" && b.Len() == 0 {
+		return ""
+	}
+
+	header := fmt.Sprintf("Slide %d", n)
+	if title != "" {
+		header += ": " + title
+	}
+	return strings.TrimSpace(header + "\n" + b.String())
+}
+
+// labelRows renders a table with the first row as headers, like a sheet.
+func labelRows(table [][]string) []string {
+	if len(table) == 0 {
+		return nil
+	}
+	if len(table) == 1 {
+		return []string{joinValues(table[0])}
+	}
+
+	headers := table[0]
+	lines := []string{"Columns: " + joinValues(headers)}
+	for _, row := range table[1:] {
+		var fields []string
+		for col, value := range row {
+			if value == "" {
+				continue
+			}
+			if col < len(headers) && headers[col] != "" {
+				value = headers[col] + ": " + value
+			}
+			fields = append(fields, value)
+		}
+		if len(fields) > 0 {
+			lines = append(lines, strings.Join(fields, " | "))
+		}
+	}
+	return lines
+}
+
+// parseSlideXML collects the text of a slide or notes page. Placeholders
+// for slide numbers, dates, footers and (on notes pages) the slide image
+// are skipped.
+func parseSlideXML(r io.Reader) (*slideText, error) {
+	t := &slideText{}
+	d := xml.NewDecoder(r)
+
+	var (
+		inShape bool
+		role    string // of the current shape: "title", "skip" or "body"
+		paras   []string
+
+		para   strings.Builder
+		inCell bool
+		cell   []string
+		row    []string
+		table  [][]string
+	)
+	for {
+		tok, err := d.Token()
+		if err == io.EOF {
+			return t, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		switch el := tok.(type) {
+		case xml.StartElement:
+			switch el.Name.Local {
+			case "sld":
+				t.hidden = attr(el, "", "show") == "0"
+			case "sp":
+				inShape, role, paras = true, "body", nil
+			case "ph":
+				switch attr(el, "", "type") {
+				case "title", "ctrTitle":
+					role = "title"
+				case "sldNum", "dt", "ftr", "hdr", "sldImg":
+					role = "skip"
+				}
+			case "tbl":
+				table = nil
+			case "tr":
+				row = nil
+			case "tc":
+				inCell, cell = true, nil
+			case "p":
+				para.Reset()
+			case "t":
+				var s string
+				if err := d.DecodeElement(&s, &el); err != nil {
+					return nil, err
+				}
+				para.WriteString(s)
+			case "br":
+				para.WriteString("\n")
+			case "blip":
+				if id := attr(el, nsRelations, "embed"); id != "" {
+					t.images = append(t.images, id)
+				}
+			}
+
+		case xml.EndElement:
+			switch el.Name.Local {
+			case "p":
+				text := strings.TrimSpace(para.String())
+				switch {
+				case text == "":
+				case inCell:
+					cell = append(cell, text)
+				case inShape:
+					paras = append(paras, text)
+				}
+			case "tc":
+				row = append(row, strings.Join(cell, " "))
+				inCell = false
+			case "tr":
+				table = append(table, row)
+			case "tbl":
+				if len(table) > 0 {
+					t.tables = append(t.tables, table)
+				}
+			case "sp":
+				switch role {
+				case "title":
+					t.title = append(t.title, paras...)
+				case "body":
+					t.body = append(t.body, paras...)
+				}
+				inShape = false
+			}
+		}
+	}
+}
+
+func attr(el xml.StartElement, space, local string) string {
+	for _, a := range el.Attr {
+		if a.Name.Local == local && a.Name.Space == space {
+			return a.Value
+		}
+	}
+	return ""
+}
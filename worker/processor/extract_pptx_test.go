@@ -0,0 +1,124 @@
+package processor
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"testing"
+)
+
+const (
+	pptxNS = `xmlns:a="http://schemas.openxmlformats.org/drawingml/2006/main" ` +
+		`xmlns:r="http://schemas.openxmlformats.org/officeDocument/2006/relationships" ` +
+		`xmlns:p="http://schemas.openxmlformats.org/presentationml/2006/main"`
+	relsNS = `xmlns="http://schemas.openxmlformats.org/package/2006/relationships"`
+)
+
+// testDeck is a deck whose first slide (by presentation order) is stored
+// as slide2.xml: a title, body text, a slide number, a table and notes.
+// The second is a scanned page with only a picture.
+var testDeck = map[string]string{
+	"ppt/presentation.xml": `<p:presentation ` + pptxNS + `><p:sldIdLst>
+		<p:sldId id="256" r:id="rId2"/><p:sldId id="257" r:id="rId1"/>
+	</p:sldIdLst></p:presentation>`,
+	"ppt/_rels/presentation.xml.rels": `<Relationships ` + relsNS + `>
+		<Relationship Id="rId1" Type="` + relSlide + `" Target="slides/slide1.xml"/>
+		<Relationship Id="rId2" Type="` + relSlide + `" Target="slides/slide2.xml"/>
+	</Relationships>`,
+
+	"ppt/slides/slide2.xml": `<p:sld ` + pptxNS + `><p:cSld><p:spTree>
+		<p:sp><p:nvSpPr><p:nvPr><p:ph type="title"/></p:nvPr></p:nvSpPr>
+			<p:txBody><a:p><a:r><a:t>Tarif </a:t></a:r><a:r><a:t>2025</a:t></a:r></a:p></p:txBody></p:sp>
+		<p:sp><p:txBody><a:p><a:r><a:t>Berlaku nasional</a:t></a:r></a:p><a:p></a:p></p:txBody></p:sp>
+		<p:sp><p:nvSpPr><p:nvPr><p:ph type="sldNum"/></p:nvPr></p:nvSpPr>
+			<p:txBody><a:p><a:r><a:t>7</a:t></a:r></a:p></p:txBody></p:sp>
+		<p:graphicFrame><a:graphic><a:graphicData><a:tbl>
+			<a:tr><a:tc><a:txBody><a:p><a:r><a:t>Kelas</a:t></a:r></a:p></a:txBody></a:tc>
+				<a:tc><a:txBody><a:p><a:r><a:t>Harga</a:t></a:r></a:p></a:txBody></a:tc></a:tr>
+			<a:tr><a:tc><a:txBody><a:p><a:r><a:t>Bisnis</a:t></a:r></a:p></a:txBody></a:tc>
+				<a:tc><a:txBody><a:p><a:r><a:t>150000</a:t></a:r></a:p></a:txBody></a:tc></a:tr>
+		</a:tbl></a:graphicData></a:graphic></p:graphicFrame>
+	</p:spTree></p:cSld></p:sld>`,
+	"ppt/slides/_rels/slide2.xml.rels": `<Relationships ` + relsNS + `>
+		<Relationship Id="rId1" Type="` + relNotesSlide + `" Target="../notesSlides/notesSlide1.xml"/>
+	</Relationships>`,
+	"ppt/notesSlides/notesSlide1.xml": `<p:notes ` + pptxNS + `><p:cSld><p:spTree>
+		<p:sp><p:nvSpPr><p:nvPr><p:ph type="sldImg"/></p:nvPr></p:nvSpPr></p:sp>
+		<p:sp><p:txBody><a:p><a:r><a:t>Sebutkan pengecualian.</a:t></a:r></a:p></p:txBody></p:sp>
+	</p:spTree></p:cSld></p:notes>`,
+
+	"ppt/slides/slide1.xml": `<p:sld ` + pptxNS + ` show="0"><p:cSld><p:spTree>
+		<p:pic><p:blipFill><a:blip r:embed="rId1"/></p:blipFill></p:pic>
+		<p:pic><p:blipFill><a:blip r:embed="rId2"/></p:blipFill></p:pic>
+	</p:spTree></p:cSld></p:sld>`,
+	"ppt/slides/_rels/slide1.xml.rels": `<Relationships ` + relsNS + `>
+		<Relationship Id="rId1" Type="image" Target="../media/image1.png"/>
+		<Relationship Id="rId2" Type="image" Target="../media/image2.emf"/>
+	</Relationships>`,
+	"ppt/media/image1.png": "scan",
+	"ppt/media/image2.emf": "a larger vector logo Gemini can't read",
+}
+
+func writeZip(t *testing.T, name string, parts map[string]string) string {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for name, data := range parts {
+		w, err := zw.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write([]byte(data))
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return writeFile(t, name, buf.Bytes())
+}
+
+func TestPPTXExtractor(t *testing.T) {
+	path := writeZip(t, "deck.pptx", testDeck)
+	pages := readPages(t, pptxExtractor{}, path)
+	if len(pages) != 2 {
+		t.Fatalf("got %d pages, want one per slide", len(pages))
+	}
+
+	first := pages[0]
+	want := "Slide 1: Tarif 2025\nBerlaku nasional\nColumns: Kelas | Harga\nKelas: Bisnis | Harga: 150000"
+	if first.Text != want {
+		t.Errorf("slide 1 text = %q, want %q", first.Text, want)
+	}
+	if first.Notes != "Sebutkan pengecualian." {
+		t.Errorf("slide 1 notes = %q", first.Notes)
+	}
+	if first.Metadata["title"] != "Tarif 2025" || first.Metadata["hidden"] != false || first.OCRFallback {
+		t.Errorf("slide 1 metadata = %v, ocr fallback %v", first.Metadata, first.OCRFallback)
+	}
+
+	second := pages[1]
+	if second.Text != "" || !second.OCRFallback || second.Metadata["hidden"] != true {
+		t.Errorf("slide 2 = %q, ocr fallback %v, metadata %v; want a hidden picture slide to OCR",
+			second.Text, second.OCRFallback, second.Metadata)
+	}
+
+	src, err := pptxExtractor{}.Open(context.Background(), path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer src.Close()
+	in, err := src.(ocrSource).ocrInput(context.Background(), 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(in.Data) != "scan" || in.MIMEType != "image/png" {
+		t.Errorf("ocr input = %q (%s), want the PNG scan", in.Data, in.MIMEType)
+	}
+}
+
+func TestPPTXExtractorInvalid(t *testing.T) {
+	path := writeZip(t, "deck.pptx", map[string]string{"ppt/slides/slide1.xml": "<p:sld/>"})
+	_, err := pptxExtractor{}.Open(context.Background(), path)
+	if perr := Classify(err); err == nil || perr.Kind != KindPermanent || perr.Code != CodeInvalidFile {
+		t.Fatalf("Open = %v, want a permanent %s error", err, CodeInvalidFile)
+	}
+}
@@ -0,0 +1,71 @@
+package processor
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// writeFile writes data to a file called name in a temporary directory and
+// returns its path.
+func writeFile(t *testing.T, name string, data []byte) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// readPages opens the file at path with e and returns all of its pages.
+func readPages(t *testing.T, e Extractor, path string) []Page {
+	t.Helper()
+	ctx := context.Background()
+	src, err := e.Open(ctx, path)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer src.Close()
+
+	var pages []Page
+	for n := 1; n <= src.Count(); n++ {
+		page, err := src.Page(ctx, n)
+		if err != nil {
+			t.Fatalf("Page(%d): %v", n, err)
+		}
+		pages = append(pages, page)
+	}
+	return pages
+}
+
+func TestDetectType(t *testing.T) {
+	tests := []struct {
+		name    string
+		file    string
+		content string
+		want    string
+	}{
+		{"pdf", "a.pdf", "%PDF-1.7\n%\xe2\xe3\xcf\xd3\n1 0 obj", mimePDF},
+		{"pdf without extension", "upload", "%PDF-1.4\n", mimePDF},
+		{"text mentioning the pdf header", "notes.txt", "Files start with %PDF-1.7, then a binary comment.\n", mimeText},
+		{"markdown mentioning the pdf header", "notes.md", "# Notes\n\nThe header is `%PDF-`.\n", mimeMarkdown},
+		{"pdf header on a later line", "a.pdf", "hello\n%PDF-1.7\n", mimeText},
+		{"html", "page.htm", "<!DOCTYPE html><html><body>x</body></html>", mimeHTML},
+		{"html after a utf-8 bom", "page.html", "\xef\xbb\xbf<html><body>x</body></html>", mimeHTML},
+		{"tiff little endian", "scan.tif", "II*\x00\x08\x00\x00\x00", mimeTIFF},
+		{"tiff big endian", "scan", "MM\x00*\x00\x00\x00\x08", mimeTIFF},
+		{"png", "a.png", "\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR", mimePNG},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := detectType(writeFile(t, tt.file, []byte(tt.content)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("detectType = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
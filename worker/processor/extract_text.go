@@ -0,0 +1,280 @@
+package processor
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/net/html/charset"
+)
+
+// textExtractor reads plain text or Markdown. The file has no pages of its
+// own, so it is split into logical ones (splitPages) for page numbers in
+// citations to point somewhere useful.
+type textExtractor struct {
+	format PageMethod // MethodText or MethodMarkdown
+}
+
+func (e textExtractor) Open(ctx context.Context, path string) (PageSource, error) {
+	text, err := readText(path, mimeText)
+	if err != nil {
+		return nil, Permanent(CodeInvalidFile, fmt.Errorf("failed to read text: %v", err))
+	}
+	heading := plainHeading
+	if e.format == MethodMarkdown {
+		heading = markdownHeading
+	}
+	return textPages(text, heading, e.format, nil)
+}
+
+// readText reads the file at path as UTF-8. The encoding comes from a BOM
+// or, for HTML, a <meta charset>; failing those, text that isn't valid
+// UTF-8 is taken to be Windows-1252, as older Windows exports are.
+func readText(path, contentType string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	r, err := charset.NewReader(f, contentType)
+	if err != nil {
+		return "", err
+	}
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return "", err
+	}
+	text := strings.TrimPrefix(string(data), "\ufeff")
+	text = strings.ReplaceAll(text, "\r\n", "\n")
+	return strings.ReplaceAll(text, "\r", "\n"), nil
+}
+
+// textPages splits text into pages of the given method. Every page records
+// the heading it falls under, and every other one it covers, plus meta if
+// given.
+func textPages(text string, heading headingFunc, method PageMethod, meta map[string]any) (PageSource, error) {
+	var pages pageList
+	for _, tp := range splitPages(text, heading) {
+		page := Page{Text: tp.text, Method: method}
+		if len(meta) > 0 || len(tp.headings) > 0 {
+			page.Metadata = map[string]any{}
+			for k, v := range meta {
+				page.Metadata[k] = v
+			}
+			if len(tp.headings) > 0 {
+				page.Metadata["heading"] = tp.headings[0]
+			}
+			if len(tp.headings) > 1 {
+				page.Metadata["headings"] = tp.headings
+			}
+		}
+		pages = append(pages, page)
+	}
+	if len(pages) == 0 {
+		return nil, Permanent(CodeInvalidFile, fmt.Errorf("file has no text"))
+	}
+	return pages, nil
+}
+
+// Page sizes for splitPages, in characters. maxPageChars is about a printed
+// page; sections shorter than minPageChars share a page with the next one.
+const (
+	maxPageChars = 3000
+	minPageChars = 300
+)
+
+type textPage struct {
+	// headings are the sections the page covers: the one it starts in,
+	// then any that begin on it.
+	headings []string
+	text     string
+}
+
+// splitPages cuts text into logical pages. A page starts at each heading of
+// the top two levels the text uses, unless the page so far is too short to
+// stand alone, and at each form feed. Pages longer than maxPageChars are cut
+// further at paragraph, then line, then word boundaries.
+func splitPages(text string, heading headingFunc) []textPage {
+	top := 0
+	fenced := false
+	for _, line := range strings.Split(text, "\n") {
+		if isFence(line) {
+			fenced = !fenced
+		}
+		if level, _ := heading(line); !fenced && level > 0 && (top == 0 || level < top) {
+			top = level
+		}
+	}
+	isSplit := func(line string) (bool, string) {
+		level, title := heading(line)
+		return level > 0 && level <= top+1, title
+	}
+
+	var (
+		pages       []textPage
+		lines       []string
+		size        int
+		under       string // last heading before the lines being flushed
+		startFenced bool   // whether the open page starts in a code block
+	)
+	fenced = false
+	flush := func() {
+		body := strings.TrimSpace(strings.Join(lines, "\n"))
+		inFence := startFenced
+		lines, size, startFenced = nil, 0, fenced
+		if body == "" {
+			return
+		}
+		for _, part := range packText(body, maxPageChars) {
+			var headings []string
+			for i, line := range strings.Split(part, "\n") {
+				if isFence(line) {
+					inFence = !inFence
+					continue
+				}
+				ok, title := isSplit(line)
+				if !ok || inFence {
+					continue
+				}
+				if i > 0 && len(headings) == 0 && under != "" {
+					headings = append(headings, under) // the page starts mid-section
+				}
+				headings = append(headings, title)
+				under = title
+			}
+			if len(headings) == 0 && under != "" {
+				headings = []string{under}
+			}
+			pages = append(pages, textPage{headings: headings, text: part})
+		}
+	}
+
+	for i, block := range strings.Split(text, "\f") {
+		if i > 0 {
+			flush()
+		}
+		for _, line := range strings.Split(block, "\n") {
+			if isFence(line) {
+				fenced = !fenced
+			} else if ok, _ := isSplit(line); ok && !fenced && size >= minPageChars {
+				flush()
+			}
+			lines = append(lines, line)
+			size += utf8.RuneCountInString(line) + 1
+		}
+	}
+	flush()
+	return pages
+}
+
+// packText cuts text into pieces of at most max characters, preferring the
+// coarsest boundary that works.
+func packText(text string, max int) []string {
+	if utf8.RuneCountInString(text) <= max {
+		return []string{text}
+	}
+	for _, sep := range []string{"\n\n", "\n", " "} {
+		if parts := strings.Split(text, sep); len(parts) > 1 {
+			return packParts(parts, sep, max)
+		}
+	}
+
+	// One unbroken word
+	var pieces []string
+	runes := []rune(text)
+	for len(runes) > max {
+		pieces = append(pieces, string(runes[:max]))
+		runes = runes[max:]
+	}
+	return append(pieces, string(runes))
+}
+
+func packParts(parts []string, sep string, max int) []string {
+	var (
+		pieces []string
+		cur    strings.Builder
+		size   int
+	)
+	flush := func() {
+		if s := strings.TrimSpace(cur.String()); s != "" {
+			pieces = append(pieces, s)
+		}
+		cur.Reset()
+		size = 0
+	}
+	for _, part := range parts {
+		n := utf8.RuneCountInString(part)
+		if n > max {
+			flush()
+			pieces = append(pieces, packText(part, max)...)
+			continue
+		}
+		if size > 0 && size+len(sep)+n > max {
+			flush()
+		}
+		if size > 0 {
+			cur.WriteString(sep)
+			size += len(sep)
+		}
+		cur.WriteString(part)
+		size += n
+	}
+	flush()
+	return pieces
+}
+
+// headingFunc reports whether a line is a heading: its level (1 for the
+// top) and title, or 0 if it isn't one.
+type headingFunc func(line string) (int, string)
+
+// markdownHeading recognises ATX headings ("## Title").
+func markdownHeading(line string) (int, string) {
+	trimmed := strings.TrimLeft(line, " ")
+	if len(line)-len(trimmed) > 3 {
+		return 0, "" // indented code
+	}
+	level := 0
+	for level < len(trimmed) && trimmed[level] == '#' {
+		level++
+	}
+	if level == 0 || level > 6 {
+		return 0, ""
+	}
+	rest := trimmed[level:]
+	if rest != "" && rest[0] != ' ' && rest[0] != '\t' {
+		return 0, "" // "#hashtag"
+	}
+	title := strings.TrimSpace(strings.TrimRight(strings.TrimSpace(rest), "#"))
+	return level, title
+}
+
+// Chapter and article lines of regulations exported as plain text.
+var (
+	chapterLine = regexp.MustCompile(`^(?i:bab)\s+[IVXLCDM0-9]+\.?$`)
+	articleLine = regexp.MustCompile(`^(?i:pasal)\s+[0-9]+[A-Za-z]?\.?$`)
+)
+
+// plainHeading recognises the "BAB I" and "Pasal 1" lines that structure
+// regulations and circulars, the only headings plain text reliably has.
+func plainHeading(line string) (int, string) {
+	line = strings.TrimSpace(line)
+	switch {
+	case chapterLine.MatchString(line):
+		return 1, line
+	case articleLine.MatchString(line):
+		return 2, line
+	}
+	return 0, ""
+}
+
+// isFence reports whether line opens or closes a Markdown code block, where
+// "#" lines are comments rather than headings.
+func isFence(line string) bool {
+	line = strings.TrimSpace(line)
+	return strings.HasPrefix(line, "```") || strings.HasPrefix(line, "~~~")
+}
@@ -0,0 +1,214 @@
+package processor
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestMarkdownHeading(t *testing.T) {
+	tests := []struct {
+		line      string
+		wantLevel int
+		wantTitle string
+	}{
+		{"# Title", 1, "Title"},
+		{"### Pasal 3 ###", 3, "Pasal 3"},
+		{"   ## Indented", 2, "Indented"},
+		{"#\tTab", 1, "Tab"},
+		{"#", 1, ""},
+		{"    # Code", 0, ""},
+		{"#hashtag", 0, ""},
+		{"####### Seven", 0, ""},
+		{"Plain text", 0, ""},
+	}
+	for _, tt := range tests {
+		level, title := markdownHeading(tt.line)
+		if level != tt.wantLevel || title != tt.wantTitle {
+			t.Errorf("markdownHeading(%q) = %d, %q; want %d, %q", tt.line, level, title, tt.wantLevel, tt.wantTitle)
+		}
+	}
+}
+
+func TestPlainHeading(t *testing.T) {
+	tests := []struct {
+		line      string
+		wantLevel int
+		wantTitle string
+	}{
+		{"BAB I", 1, "BAB I"},
+		{"  Bab XIV.  ", 1, "Bab XIV."},
+		{"BAB 2", 1, "BAB 2"},
+		{"Pasal 1", 2, "Pasal 1"},
+		{"PASAL 12A", 2, "PASAL 12A"},
+		{"Pasal 1 ayat (2) berlaku", 0, ""},
+		{"sebagaimana dimaksud dalam Pasal 5", 0, ""},
+		{"BABAK I", 0, ""},
+	}
+	for _, tt := range tests {
+		level, title := plainHeading(tt.line)
+		if level != tt.wantLevel || title != tt.wantTitle {
+			t.Errorf("plainHeading(%q) = %d, %q; want %d, %q", tt.line, level, title, tt.wantLevel, tt.wantTitle)
+		}
+	}
+}
+
+func TestPackText(t *testing.T) {
+	tests := []struct {
+		name string
+		text string
+		max  int
+		want []string
+	}{
+		{"fits", "one two", 10, []string{"one two"}},
+		{"paragraphs", "aaaa\n\nbbbb\n\ncccc", 10, []string{"aaaa\n\nbbbb", "cccc"}},
+		{"lines", "aaaa\nbbbb\ncccc", 9, []string{"aaaa\nbbbb", "cccc"}},
+		{"words", "aaa bbb ccc", 7, []string{"aaa bbb", "ccc"}},
+		{"long word", "abcdefghij", 4, []string{"abcd", "efgh", "ij"}},
+		{"long paragraph among short ones", "aa\n\nbbbbbb bbbbbb\n\ncc", 8, []string{"aa", "bbbbbb", "bbbbbb", "cc"}},
+		{"counts runes", "äöü äöü", 7, []string{"äöü äöü"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := packText(tt.text, tt.max)
+			if !slices.Equal(got, tt.want) {
+				t.Fatalf("packText = %q, want %q", got, tt.want)
+			}
+			for _, piece := range got {
+				if n := utf8.RuneCountInString(piece); n > tt.max {
+					t.Errorf("piece %q has %d characters, over %d", piece, n, tt.max)
+				}
+			}
+		})
+	}
+}
+
+func TestSplitPages(t *testing.T) {
+	long := strings.Repeat("Lorem ipsum dolor sit amet. ", 12) // over minPageChars
+	short := "Short section."
+
+	tests := []struct {
+		name    string
+		text    string
+		heading headingFunc
+		want    [][]string // headings of each page
+	}{
+		{
+			name:    "one page per long section",
+			text:    "# A\n" + long + "\n# B\n" + long,
+			heading: markdownHeading,
+			want:    [][]string{{"A"}, {"B"}},
+		},
+		{
+			name:    "short section shares a page and keeps both headings",
+			text:    "# A\n" + short + "\n# B\n" + long + "\n# C\n" + long,
+			heading: markdownHeading,
+			want:    [][]string{{"A", "B"}, {"C"}},
+		},
+		{
+			name:    "intro before the first heading",
+			text:    short + "\n# A\n" + long,
+			heading: markdownHeading,
+			want:    [][]string{{"A"}},
+		},
+		{
+			name:    "lower levels don't split",
+			text:    "# A\n" + long + "\n## A.1\n" + long + "\n### A.1.a\n" + long,
+			heading: markdownHeading,
+			want:    [][]string{{"A"}, {"A.1"}},
+		},
+		{
+			name:    "headings in code blocks are comments",
+			text:    "# A\n" + long + "\n```sh\n# not a heading\n" + long + "\n```\n# B\n" + short,
+			heading: markdownHeading,
+			want:    [][]string{{"A"}, {"B"}},
+		},
+		{
+			name:    "form feed starts a page under the same heading",
+			text:    "# A\n" + short + "\f" + short,
+			heading: markdownHeading,
+			want:    [][]string{{"A"}, {"A"}},
+		},
+		{
+			name:    "regulation chapters and articles",
+			text:    "BAB I\nPasal 1\n" + long + "\nPasal 2\n" + long + "\nBAB II\nPasal 3\n" + long,
+			heading: plainHeading,
+			want:    [][]string{{"BAB I", "Pasal 1"}, {"Pasal 2"}, {"BAB II", "Pasal 3"}},
+		},
+		{
+			name:    "no headings",
+			text:    short + "\n\n" + short,
+			heading: plainHeading,
+			want:    [][]string{nil},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pages := splitPages(tt.text, tt.heading)
+			if len(pages) != len(tt.want) {
+				t.Fatalf("got %d pages, want %d: %q", len(pages), len(tt.want), pages)
+			}
+			for i, page := range pages {
+				if !slices.Equal(page.headings, tt.want[i]) {
+					t.Errorf("page %d headings = %q, want %q", i+1, page.headings, tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+// A section too long for one page is cut into several, each under the
+// heading it continues, with none over maxPageChars.
+func TestSplitPagesLongSection(t *testing.T) {
+	para := strings.Repeat("word ", 179) + "end." // 899 characters
+	text := "# A\n" + strings.Repeat(para+"\n\n", 5) + "# B\n" + para
+
+	pages := splitPages(text, markdownHeading)
+	want := [][]string{{"A"}, {"A"}, {"B"}}
+	if len(pages) != len(want) {
+		t.Fatalf("got %d pages, want %d", len(pages), len(want))
+	}
+	for i, page := range pages {
+		if !slices.Equal(page.headings, want[i]) {
+			t.Errorf("page %d headings = %q, want %q", i+1, page.headings, want[i])
+		}
+		if n := utf8.RuneCountInString(page.text); n > maxPageChars {
+			t.Errorf("page %d has %d characters, over %d", i+1, n, maxPageChars)
+		}
+	}
+}
+
+func TestTextExtractor(t *testing.T) {
+	tests := []struct {
+		name    string
+		format  PageMethod
+		content string
+		want    string
+	}{
+		{"utf-8 with bom and crlf", MethodText, "\xef\xbb\xbfBAB I\r\nKetentuan umum\r\n", "BAB I\nKetentuan umum"},
+		{"windows-1252", MethodText, "Caf\xe9 \x93quoted\x94", "Café “quoted”"},
+		{"markdown", MethodMarkdown, "# Judul\n\nIsi.\n", "# Judul\n\nIsi."},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pages := readPages(t, textExtractor{format: tt.format}, writeFile(t, "file.txt", []byte(tt.content)))
+			if len(pages) != 1 {
+				t.Fatalf("got %d pages, want 1", len(pages))
+			}
+			if pages[0].Text != tt.want || pages[0].Method != tt.format {
+				t.Errorf("page = %q (%s), want %q (%s)", pages[0].Text, pages[0].Method, tt.want, tt.format)
+			}
+		})
+	}
+}
+
+func TestTextExtractorEmpty(t *testing.T) {
+	_, err := textExtractor{format: MethodText}.Open(context.Background(), writeFile(t, "empty.txt", []byte(" \r\n\n")))
+	var perr *Error
+	if !errors.As(err, &perr) || perr.Kind != KindPermanent || perr.Code != CodeInvalidFile {
+		t.Fatalf("Open = %v, want a permanent %s error", err, CodeInvalidFile)
+	}
+}
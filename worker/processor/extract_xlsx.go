@@ -0,0 +1,148 @@
+package processor
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/xuri/excelize/v2"
+)
+
+// xlsxExtractor reads a workbook with one page per sheet. Every data row
+// becomes one line with each value labelled by its column header, e.g.
+//
+//	Row 4: Stasiun: Gambir | Berangkat: 08:00 | Kelas: Eksekutif
+//
+// so a chunk cut from the middle of a sheet still says what its numbers
+// mean. Values are rendered with the cell's number format, as Excel shows them.
+type xlsxExtractor struct{}
+
+func (xlsxExtractor) Open(ctx context.Context, path string) (PageSource, error) {
+	f, err := excelize.OpenFile(path)
+	if err != nil {
+		return nil, Permanent(CodeInvalidFile, fmt.Errorf("failed to read xlsx: %v", err))
+	}
+	return &xlsxSource{file: f, sheets: f.GetSheetList()}, nil
+}
+
+type xlsxSource struct {
+	file   *excelize.File
+	sheets []string
+}
+
+func (s *xlsxSource) Count() int {
+	return len(s.sheets)
+}
+
+func (s *xlsxSource) Page(ctx context.Context, n int) (Page, error) {
+	if n < 1 || n > len(s.sheets) {
+		return Page{}, fmt.Errorf("sheet %d out of range", n)
+	}
+	sheet := s.sheets[n-1]
+	rows, err := s.file.GetRows(sheet)
+	if err != nil {
+		return Page{}, Permanent(CodeInvalidFile, fmt.Errorf("failed to read sheet %q: %v", sheet, err))
+	}
+
+	text, dataRows := renderSheet(sheet, rows)
+	return Page{
+		Text:   text,
+		Method: MethodXLSX,
+		Metadata: map[string]any{
+			"sheet":       sheet,
+			"sheet_index": n,
+			"rows":        dataRows,
+		},
+	}, nil
+}
+
+func (s *xlsxSource) Close() error {
+	return s.file.Close()
+}
+
+// renderSheet turns a sheet's rows into header-labelled lines and returns
+// the text and the number of data rows in it. The header is the first row
+// with at least two values; rows above it (titles, notes) are kept as they
+// are. Empty rows are dropped.
+func renderSheet(sheet string, rows [][]string) (string, int) {
+	header := -1
+	for i, row := range rows {
+		if countValues(row) >= 2 {
+			header = i
+			break
+		}
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "Sheet: %s\n", sheet)
+
+	if header < 0 {
+		// No table, just loose values
+		for _, row := range rows {
+			if line := joinValues(row); line != "" {
+				b.WriteString(line + "\n")
+			}
+		}
+		return strings.TrimSpace(b.String()), 0
+	}
+
+	for _, row := range rows[:header] {
+		if line := joinValues(row); line != "" {
+			b.WriteString(line + "\n")
+		}
+	}
+
+	labels := make([]string, len(rows[header]))
+	for col, name := range rows[header] {
+		labels[col] = strings.TrimSpace(name)
+	}
+	fmt.Fprintf(&b, "Columns: %s\n", joinValues(labels))
+
+	dataRows := 0
+	for i, row := range rows[header+1:] {
+		var fields []string
+		for col, value := range row {
+			value = strings.TrimSpace(value)
+			if value == "" {
+				continue
+			}
+			label := ""
+			if col < len(labels) {
+				label = labels[col]
+			}
+			if label == "" {
+				// Unlabelled column: fall back to its letter
+				label, _ = excelize.ColumnNumberToName(col + 1)
+			}
+			fields = append(fields, label+": "+value)
+		}
+		if len(fields) == 0 {
+			continue
+		}
+		// Spreadsheet row numbers, as the user would look them up
+		fmt.Fprintf(&b, "Row %d: %s\n", header+i+2, strings.Join(fields, " | "))
+		dataRows++
+	}
+	return strings.TrimSpace(b.String()), dataRows
+}
+
+func countValues(row []string) int {
+	n := 0
+	for _, v := range row {
+		if strings.TrimSpace(v) != "" {
+			n++
+		}
+	}
+	return n
+}
+
+// joinValues joins a row's non-empty values.
+func joinValues(row []string) string {
+	var values []string
+	for _, v := range row {
+		if v = strings.TrimSpace(v); v != "" {
+			values = append(values, v)
+		}
+	}
+	return strings.Join(values, " | ")
+}
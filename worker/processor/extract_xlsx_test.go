@@ -0,0 +1,78 @@
+package processor
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/xuri/excelize/v2"
+)
+
+func TestRenderSheet(t *testing.T) {
+	tests := []struct {
+		name     string
+		rows     [][]string
+		want     string
+		wantRows int
+	}{
+		{
+			name: "title above the header",
+			rows: [][]string{
+				{"Jadwal Kereta"},
+				{},
+				{"Stasiun", "Berangkat", "Kelas"},
+				{"Gambir", "08:00", "Eksekutif"},
+				{"", "", ""},
+				{"Bandung", "", "Bisnis"},
+			},
+			want: "Sheet: S1\nJadwal Kereta\nColumns: Stasiun | Berangkat | Kelas\n" +
+				"Row 4: Stasiun: Gambir | Berangkat: 08:00 | Kelas: Eksekutif\n" +
+				"Row 6: Stasiun: Bandung | Kelas: Bisnis",
+			wantRows: 2,
+		},
+		{
+			name:     "unlabelled column",
+			rows:     [][]string{{"Kode", "", "Nama"}, {"A", "x", "Kopi"}, {"B", "", "Teh", "catatan"}},
+			want:     "Sheet: S1\nColumns: Kode | Nama\nRow 2: Kode: A | B: x | Nama: Kopi\nRow 3: Kode: B | Nama: Teh | D: catatan",
+			wantRows: 2,
+		},
+		{
+			name:     "loose values",
+			rows:     [][]string{{"Catatan"}, {}, {"", "Lihat lampiran"}},
+			want:     "Sheet: S1\nCatatan\nLihat lampiran",
+			wantRows: 0,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, rows := renderSheet("S1", tt.rows)
+			if got != tt.want || rows != tt.wantRows {
+				t.Errorf("renderSheet = %q, %d rows; want %q, %d rows", got, rows, tt.want, tt.wantRows)
+			}
+		})
+	}
+}
+
+func TestXLSXExtractor(t *testing.T) {
+	f := excelize.NewFile()
+	f.SetSheetRow("Sheet1", "A1", &[]any{"Produk", "Harga"})
+	f.SetSheetRow("Sheet1", "A2", &[]any{"Kopi", 12500})
+	f.NewSheet("Kosong")
+	path := filepath.Join(t.TempDir(), "book.xlsx")
+	if err := f.SaveAs(path); err != nil {
+		t.Fatal(err)
+	}
+
+	pages := readPages(t, xlsxExtractor{}, path)
+	if len(pages) != 2 {
+		t.Fatalf("got %d pages, want one per sheet", len(pages))
+	}
+	if want := "Sheet: Sheet1\nColumns: Produk | Harga\nRow 2: Produk: Kopi | Harga: 12500"; pages[0].Text != want {
+		t.Errorf("sheet 1 = %q, want %q", pages[0].Text, want)
+	}
+	if pages[0].Metadata["sheet"] != "Sheet1" || pages[0].Metadata["rows"] != 1 {
+		t.Errorf("sheet 1 metadata = %v", pages[0].Metadata)
+	}
+	if pages[1].Text != "Sheet: Kosong" || pages[1].Metadata["sheet_index"] != 2 {
+		t.Errorf("sheet 2 = %q, metadata %v", pages[1].Text, pages[1].Metadata)
+	}
+}
@@ -0,0 +1,99 @@
+package processor
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"path"
+	"strings"
+
+	"kai-worker/logging"
+)
+
+// folderListBatch is how many object names are listed, and offered to
+// enqueue_folder_files, per call.
+const folderListBatch = 500
+
+// ingestFolder creates a document and a child ingest job for every file
+// under the job's Storage prefix that no document points to yet. The
+// children run as ordinary jobs; folder_job_progress sums them up.
+func (p *Processor) ingestFolder(ctx context.Context, st *stageTracker, job Job) error {
+	prefix, err := folderPrefix(job.Params.Prefix)
+	if err != nil {
+		return Permanent(CodeInvalidParams, err)
+	}
+	ctx = logging.With(ctx, "prefix", prefix)
+
+	after := ""
+	files, queued := 0, 0
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		var objects []struct {
+			Name string `json:"name"`
+		}
+		lctx, endList := st.begin(ctx, StageListing, 0)
+		err := p.rpc.Call(lctx, "list_storage_objects", map[string]interface{}{
+			"p_bucket": p.cfg.Supabase.Bucket,
+			"p_prefix": prefix,
+			"p_after":  after,
+			"p_limit":  folderListBatch,
+		}, &objects)
+		endList()
+		if err != nil {
+			return Transient(CodeDatabase, fmt.Errorf("list objects: %w", err))
+		}
+		if len(objects) == 0 {
+			break
+		}
+
+		var paths []string
+		for _, o := range objects {
+			if ingestible(o.Name) {
+				paths = append(paths, o.Name)
+			}
+		}
+		if len(paths) > 0 {
+			var children []Job
+			pctx, endPersist := st.begin(ctx, StagePersisting, 0)
+			err := p.rpc.Call(pctx, "enqueue_folder_files", map[string]interface{}{
+				"p_parent_id": job.ID,
+				"p_paths":     paths,
+			}, &children)
+			endPersist()
+			if err != nil {
+				return Transient(CodeDatabase, fmt.Errorf("queue folder files: %w", err))
+			}
+			for _, c := range children {
+				slog.DebugContext(ctx, "queued folder file", "child_job_id", c.ID, "child_document_id", c.DocumentID)
+			}
+			files += len(paths)
+			queued += len(children)
+		}
+
+		after = objects[len(objects)-1].Name
+		if len(objects) < folderListBatch {
+			break
+		}
+	}
+
+	if files == 0 {
+		return Permanent(CodeEmptyFolder, fmt.Errorf("no supported files under %q in bucket %s", prefix, p.cfg.Supabase.Bucket))
+	}
+	slog.InfoContext(ctx, "queued folder", "files", files, "new", queued, "known", files-queued)
+	return nil
+}
+
+// folderPrefix cleans a Storage folder into "a/b/" form, so "a/b" doesn't
+// also match "a/bc/". The bucket root is refused: ingesting everything is
+// never what a folder job means.
+func folderPrefix(raw string) (string, error) {
+	cleaned := strings.Trim(path.Clean("/"+strings.TrimSpace(raw)), "/")
+	if cleaned == "" {
+		return "", errors.New("folder job needs a storage prefix (params.prefix)")
+	}
+	return cleaned + "/", nil
+}
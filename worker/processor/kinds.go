@@ -0,0 +1,291 @@
+package processor
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+
+	"github.com/supabase-community/postgrest-go"
+)
+
+// JobKind says what a job does to its document. Stored in jobs.kind.
+type JobKind string
+
+const (
+	// KindIngest downloads the file and fully processes it (the upload path).
+	KindIngest JobKind = "ingest"
+	// KindRechunk rebuilds chunks and embeddings from stored document_pages text.
+	KindRechunk JobKind = "rechunk"
+	// KindReembed recomputes embeddings for existing chunks, text unchanged.
+	KindReembed JobKind = "reembed"
+	// KindReOCR forces Gemini OCR on selected pages (all pages if none given).
+	KindReOCR JobKind = "reocr"
+	// KindPurge removes the document's chunks from search.
+	KindPurge JobKind = "purge"
+	// KindIngestFolder creates a document and child ingest job for every
+	// new file under a Storage prefix. It has no document of its own.
+	KindIngestFolder JobKind = "ingest_folder"
+)
+
+// JobParams holds kind-specific options from jobs.params.
+type JobParams struct {
+	// Pages limits a reocr job to these page numbers.
+	Pages []int `json:"pages,omitempty"`
+	// OnlyMissing limits a reembed job to chunks without an embedding.
+	OnlyMissing bool `json:"only_missing,omitempty"`
+	// Prefix is the Storage folder an ingest_folder job ingests.
+	Prefix string `json:"prefix,omitempty"`
+}
+
+// OwnsDocumentStatus reports whether jobs of this kind move their document
+// from processing to ready or error. Only ingest does: the other kinds work
+// on a document that is already there, often queued by maintenance, and a
+// failed reembed must not take a searchable document offline. Their errors
+// stay on the job.
+func (k JobKind) OwnsDocumentStatus() bool {
+	return k == KindIngest || k == ""
+}
+
+// rechunk re-chunks and re-embeds every stored page, without downloading or
+// re-extracting the file. Use it after changing chunk size or overlap.
+func (p *Processor) rechunk(ctx context.Context, st *stageTracker, doc Document) error {
+	// Pages an earlier run of this job already rechunked are kept
+	done, err := p.completedPages(ctx, doc.ID, st.jobID)
+	if err != nil {
+		slog.WarnContext(ctx, "failed to load page checkpoints; rechunking every page", "error", err)
+	}
+
+	lastPage := 0
+	for {
+		var pages []struct {
+			PageNumber int    `json:"page_number"`
+			Text       string `json:"text"`
+		}
+		_, err := p.client.From("document_pages").
+			Select("page_number, text", "", false).
+			Eq("document_id", doc.ID).
+			Gt("page_number", fmt.Sprintf("%d", lastPage)).
+			Order("page_number", &postgrest.OrderOpts{Ascending: true}).
+			Limit(100, "").
+			ExecuteTo(&pages)
+		if err != nil {
+			return Transient(CodeDatabase, fmt.Errorf("load pages: %w", err))
+		}
+		if len(pages) == 0 {
+			break
+		}
+
+		for _, page := range pages {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			if !done[page.PageNumber] {
+				if err := p.rechunkPage(ctx, st, doc.ID, page.PageNumber, page.Text); err != nil {
+					return err
+				}
+			}
+			lastPage = page.PageNumber
+		}
+	}
+
+	slog.InfoContext(ctx, "rechunked document", "pages", lastPage)
+	return nil
+}
+
+// rechunkPage replaces one stored page's chunks within the page deadline.
+func (p *Processor) rechunkPage(ctx context.Context, st *stageTracker, documentID string, pageNum int, text string) error {
+	ctx, cancel := withDeadline(ctx, "page", p.cfg.Timeouts.Page)
+	defer cancel()
+
+	chunkCount, err := p.replaceChunks(ctx, st, documentID, pageNum, text)
+	if err != nil {
+		return deadlineError(ctx, err)
+	}
+	return p.markPageComplete(ctx, st, documentID, pageNum, text, chunkCount)
+}
+
+// reembed recomputes embeddings for the document's chunks in place, e.g.
+// after switching embedding models or to fill in chunks stored without one.
+func (p *Processor) reembed(ctx context.Context, st *stageTracker, doc Document, params JobParams) error {
+	type chunk struct {
+		ID         string `json:"id"`
+		DocumentID string `json:"document_id"`
+		PageNumber int    `json:"page_number"`
+		ChunkIndex int    `json:"chunk_index"`
+		Content    string `json:"content"`
+	}
+
+	lastID := "00000000-0000-0000-0000-000000000000"
+	total := 0
+	for {
+		var chunks []chunk
+		q := p.client.From("document_chunks").
+			Select("id, document_id, page_number, chunk_index, content", "", false).
+			Eq("document_id", doc.ID).
+			Gt("id", lastID)
+		if params.OnlyMissing {
+			q = q.Is("embedding", "null")
+		}
+		_, err := q.Order("id", &postgrest.OrderOpts{Ascending: true}).
+			Limit(embedBatchSize, "").
+			ExecuteTo(&chunks)
+		if err != nil {
+			return Transient(CodeDatabase, fmt.Errorf("load chunks: %w", err))
+		}
+		if len(chunks) == 0 {
+			break
+		}
+
+		texts := make([]string, len(chunks))
+		for i, c := range chunks {
+			texts[i] = c.Content
+		}
+
+		ectx, endEmbed := st.begin(ctx, StageEmbedding, 0)
+		embeddings, err := p.generateEmbeddings(ectx, texts)
+		endEmbed()
+		if err != nil {
+			return err
+		}
+		if len(embeddings) != len(chunks) {
+			return Transient(CodeGeminiError, fmt.Errorf("got %d embeddings for %d chunks", len(embeddings), len(chunks)))
+		}
+
+		rows := make([]map[string]interface{}, len(chunks))
+		for i, c := range chunks {
+			rows[i] = map[string]interface{}{
+				"id":          c.ID,
+				"document_id": c.DocumentID,
+				"page_number": c.PageNumber,
+				"chunk_index": c.ChunkIndex,
+				"content":     c.Content,
+				"embedding":   embeddings[i],
+			}
+		}
+
+		_, endPersist := st.begin(ctx, StagePersisting, 0)
+		_, _, err = p.client.From("document_chunks").Upsert(rows, "id", "minimal", "").Execute()
+		endPersist()
+		if err != nil {
+			return Transient(CodeDatabase, fmt.Errorf("save embeddings: %w", err))
+		}
+
+		total += len(chunks)
+		lastID = chunks[len(chunks)-1].ID
+	}
+
+	slog.InfoContext(ctx, "re-embedded chunks", "chunks", total)
+	return nil
+}
+
+// reocr downloads the file and replaces the text of the selected pages with
+// Gemini OCR output, regardless of how good the extracted text looked. Only
+// file types whose pages can be OCR'd (PDFs) support it.
+func (p *Processor) reocr(ctx context.Context, st *stageTracker, doc Document, params JobParams) error {
+	dctx, endDownload := st.begin(ctx, StageDownloading, 0)
+	localPath, err := p.download(dctx, doc)
+	endDownload()
+	if localPath != "" {
+		defer os.Remove(localPath)
+	}
+	if err != nil {
+		return err
+	}
+
+	mimeType, extractor, err := extractorFor(localPath)
+	if err != nil {
+		return err
+	}
+	src, err := p.open(ctx, extractor, localPath)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	ocrSrc, ok := src.(ocrSource)
+	if !ok {
+		return Permanent(CodeUnsupportedType, fmt.Errorf("re-OCR is not supported for %s files", mimeType))
+	}
+	pageCount := src.Count()
+
+	pages := params.Pages
+	if len(pages) == 0 {
+		for i := 1; i <= pageCount; i++ {
+			pages = append(pages, i)
+		}
+	}
+	for _, pageNum := range pages {
+		if pageNum < 1 || pageNum > pageCount {
+			return Permanent(CodePageOutOfRange, fmt.Errorf("page %d out of range (document has %d)", pageNum, pageCount))
+		}
+	}
+
+	// Pages an earlier run of this job already OCR'd are kept
+	done, err := p.completedPages(ctx, doc.ID, st.jobID)
+	if err != nil {
+		slog.WarnContext(ctx, "failed to load page checkpoints; OCRing every page", "error", err)
+	}
+
+	for _, pageNum := range pages {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if done[pageNum] {
+			continue
+		}
+
+		if err := p.reocrPage(ctx, st, doc.ID, src, ocrSrc, pageNum); err != nil {
+			return err
+		}
+	}
+
+	slog.InfoContext(ctx, "re-OCR'd pages", "pages", len(pages))
+	return nil
+}
+
+// reocrPage OCRs and stores one page within the page deadline.
+func (p *Processor) reocrPage(ctx context.Context, st *stageTracker, documentID string, src PageSource, ocrSrc ocrSource, pageNum int) error {
+	ctx, cancel := withDeadline(ctx, "page", p.cfg.Timeouts.Page)
+	defer cancel()
+
+	// Only for the page's metadata; the text is replaced
+	page, err := src.Page(ctx, pageNum)
+	if err != nil {
+		return deadlineError(ctx, err)
+	}
+
+	octx, endOCR := st.begin(ctx, StageOCR, pageNum)
+	text, err := p.ocrPage(octx, ocrSrc, pageNum)
+	endOCR()
+	if err != nil {
+		return err
+	}
+	if strings.TrimSpace(text) == "" {
+		slog.WarnContext(octx, "re-OCR returned no text; keeping the existing page")
+		return nil
+	}
+
+	page.Text = text
+	page.Method = MethodOCR
+	return deadlineError(ctx, p.savePage(ctx, st, documentID, pageNum, page))
+}
+
+// purge removes the document's chunks so it no longer shows up in search.
+// document_pages are kept, so a later rechunk job can restore it without
+// downloading or OCRing anything.
+func (p *Processor) purge(ctx context.Context, st *stageTracker, doc Document) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	_, endPersist := st.begin(ctx, StagePersisting, 0)
+	_, _, err := p.client.From("document_chunks").Delete("minimal", "").Eq("document_id", doc.ID).Execute()
+	endPersist()
+	if err != nil {
+		return Transient(CodeDatabase, fmt.Errorf("purge chunks: %w", err))
+	}
+
+	slog.InfoContext(ctx, "purged chunks")
+	return nil
+}
@@ -1,458 +1,642 @@
-package processor
-
-import (
-	"context"
-	"fmt"
-	"io"
-	"log"
-	"net/http"
-	"os"
-	"path/filepath"
-	"strings"
-	"sync"
-	"time"
-
-	"github.com/google/generative-ai-go/genai"
-	"github.com/ledongthuc/pdf"
-	"github.com/nguyenthenguyen/docx"
-    "github.com/pdfcpu/pdfcpu/pkg/api"
-	"github.com/pdfcpu/pdfcpu/pkg/pdfcpu/model"
-	"github.com/supabase-community/supabase-go"
-	"google.golang.org/api/option"
-)
-
-type Job struct {
-	ID         string    `json:"id"`
-	DocumentID string    `json:"document_id"`
-	UserID     string    `json:"user_id"`
-	Status     string    `json:"status"`
-	Attempts   int       `json:"attempts"`
-	CreatedAt  time.Time `json:"created_at"`
-}
-
-type Document struct {
-	ID          string `json:"id"`
-	StoragePath string `json:"storage_path"`
-}
-
-type Processor struct {
-	client      *supabase.Client
-	apiUrl      string
-	serviceKey  string
-	genAIClient *genai.Client
-}
-
-func NewProcessor(client *supabase.Client, apiUrl, serviceKey string) *Processor {
-	// Initialize Gemini Client
-	apiKey := os.Getenv("GEMINI_API_KEY")
-    if strings.Contains(apiKey, ",") {
-        apiKey = strings.TrimSpace(strings.Split(apiKey, ",")[0])
-    }
-    
-	ctx := context.Background()
-	genClient, err := genai.NewClient(ctx, option.WithAPIKey(apiKey))
-	if err != nil {
-		log.Printf("Warning: Failed to create Gemini client with key %s...: %v", apiKey[:10], err)
-	}
-
-	return &Processor{
-		client:      client,
-		apiUrl:      apiUrl,
-		serviceKey:  serviceKey,
-		genAIClient: genClient,
-	}
-}
-
-func (p *Processor) ProcessJob(job Job) error {
-	// 1. Get Document Info
-	var docs []Document
-	_, err := p.client.From("documents").Select("*", "exact", false).Eq("id", job.DocumentID).ExecuteTo(&docs)
-	if err != nil || len(docs) == 0 {
-		return fmt.Errorf("document not found: %v", err)
-	}
-	doc := docs[0]
-
-	// 2. Download File
-	downloadUrl := fmt.Sprintf("%s/storage/v1/object/kai_docs/%s", p.apiUrl, doc.StoragePath)
-	req, _ := http.NewRequest("GET", downloadUrl, nil)
-	req.Header.Set("Authorization", "Bearer "+p.serviceKey)
-
-	resp, err := http.DefaultClient.Do(req)
-	if err != nil {
-		return fmt.Errorf("download failed: %v", err)
-	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != 200 {
-		b, _ := io.ReadAll(resp.Body)
-		return fmt.Errorf("download error %d: %s", resp.StatusCode, string(b))
-	}
-
-	// Detect Extension
-	ext := strings.ToLower(filepath.Ext(doc.StoragePath))
-	if ext == "" {
-		ext = ".pdf" // Default
-	}
-
-	tempDir := os.TempDir()
-	localPath := filepath.Join(tempDir, fmt.Sprintf("%s%s", doc.ID, ext))
-	outFile, err := os.Create(localPath)
-	if err != nil {
-		return err
-	}
-	_, err = io.Copy(outFile, resp.Body)
-	outFile.Close()
-	defer os.Remove(localPath)
-
-	if ext == ".docx" {
-		return p.processDocx(doc, localPath)
-	} else {
-		return p.processPdf(doc, localPath)
-	}
-}
-
-func (p *Processor) processDocx(doc Document, path string) error {
-	r, err := docx.ReadDocxFile(path)
-	if err != nil {
-		return fmt.Errorf("failed to read docx: %v", err)
-	}
-	docxContent := r.Editable().GetContent()
-	
-	// Update pages_total to 1 (DOCX is treated as 1 unit for now, or we can try to split?)
-	// Splitting DOCX by page is hard. We'll treat it as 1 page.
-	p.client.From("documents").Update(map[string]interface{}{"pages_total": 1}, "", "").Eq("id", doc.ID).Execute()
-
-	// Save Page 1
-	p.client.From("document_chunks").Delete("", "").Eq("document_id", doc.ID).Execute()
-	p.client.From("document_pages").Delete("", "").Eq("document_id", doc.ID).Execute()
-
-	_, _, err = p.client.From("document_pages").Insert(map[string]interface{}{
-		"document_id": doc.ID,
-		"page_number": 1,
-		"text":        docxContent,
-	}, false, "", "", "exact").Execute()
-	
-	if err != nil { return err }
-
-	// Chunk and Embed
-	chunks := p.chunkText(docxContent)
-	if len(chunks) > 0 {
-		embeddings, err := p.generateEmbeddings(chunks)
-		if err != nil { return err }
-
-		var chunkInserts []map[string]interface{}
-		for idx, content := range chunks {
-			data := map[string]interface{}{
-				"document_id": doc.ID,
-				"page_number": 1,
-				"chunk_index": idx,
-				"content":     content,
-			}
-			if len(embeddings) > idx {
-				data["embedding"] = embeddings[idx]
-			}
-			chunkInserts = append(chunkInserts, data)
-		}
-		_, _, err = p.client.From("document_chunks").Insert(chunkInserts, false, "", "", "exact").Execute()
-		if err != nil { return err }
-	}
-
-	p.client.From("documents").Update(map[string]interface{}{"pages_done": 1}, "", "").Eq("id", doc.ID).Execute()
-	return nil
-}
-
-func (p *Processor) processPdf(doc Document, localPath string) error {
-	// 3. Get Page Count & Validate using ledongthuc/pdf
-	pdfFile, r, err := pdf.Open(localPath)
-	if err != nil {
-		return fmt.Errorf("invalid pdf: %v", err)
-	}
-	defer pdfFile.Close()
-	pageCount := r.NumPage()
-	
-	// Update total pages
-	_, _, err = p.client.From("documents").Update(map[string]interface{}{"pages_total": pageCount}, "", "").Eq("id", doc.ID).Execute()
-	if err != nil {
-		log.Println("Error updating pages_total:", err)
-	}
-
-	// 4. Process Pages Sequentially (to avoid 429 Rate Limits)
-	// The free tier has distinct rate limits (15 RPM), so parallel processing triggers 429s immediately.
-	const maxConcurrency = 1 
-	sem := make(chan struct{}, maxConcurrency)
-	var wg sync.WaitGroup
-	errChan := make(chan error, pageCount)
-
-	for i := 1; i <= pageCount; i++ {
-		wg.Add(1)
-		go func(pageNum int) {
-			defer wg.Done()
-			sem <- struct{}{}        // Acquire token
-			defer func() { <-sem }() // Release token
-
-            // Extract Text using Go library
-            pageText, err := p.extractTextGo(localPath, pageNum)
-			if err != nil {
-				log.Printf("extract error page %d: %v", pageNum, err)
-			}
-            
-            // Fallback: If empty, sparse (headers only), or contains garbage, try Gemini OCR
-            cleanedText := strings.TrimSpace(pageText)
-            // INCREASED THRESHOLD to 400 to catch more "image-heavy" pages with just headers
-            if len(cleanedText) < 400 || p.isGarbageText(pageText) { 
-                if p.isGarbageText(pageText) {
-                    log.Printf("⚠️ Page %d detected as garbage text. Retrying with Gemini OCR...", pageNum)
-                } else {
-                    log.Printf("⚠️ Page %d has insufficient text (len=%d < 400). Retrying with Gemini OCR...", pageNum, len(cleanedText))
-                }
-                
-                ocrText, errOCR := p.extractTextWithGemini(localPath, pageNum)
-                if errOCR != nil {
-                     log.Printf("❌ Gemini OCR failed for page %d: %v", pageNum, errOCR)
-                } else {
-                     log.Printf("✅ Gemini OCR success for page %d. Extracted %d chars", pageNum, len(ocrText))
-                     pageText = ocrText
-                }
-            }
-
-
-			// Save Page
-			fmt.Printf("Saving page %d...\n", pageNum)
-			
-			// Delete existing data for idempotency (avoid upsert constraints issues)
-			p.client.From("document_chunks").Delete("", "").Eq("document_id", doc.ID).Eq("page_number", fmt.Sprintf("%d", pageNum)).Execute()
-			p.client.From("document_pages").Delete("", "").Eq("document_id", doc.ID).Eq("page_number", fmt.Sprintf("%d", pageNum)).Execute()
-
-			_, _, err = p.client.From("document_pages").Insert(map[string]interface{}{
-				"document_id": doc.ID,
-				"page_number": pageNum,
-				"text":        pageText,
-			}, false, "", "", "exact").Execute()
-
-			if err != nil {
-				log.Printf("Failed to save page %d: %v", pageNum, err)
-				errChan <- fmt.Errorf("page %d save failed: %w", pageNum, err)
-				return
-			}
-			fmt.Printf("Page %d saved. Chunking...\n", pageNum)
-
-			// Chunking & Embeddings & Batch Insert
-			chunks := p.chunkText(pageText)
-			fmt.Printf("Page %d chunks: %d\n", pageNum, len(chunks))
-			if len(chunks) > 0 {
-				var chunkInserts []map[string]interface{}
-				
-				// Generate embeddings
-				fmt.Printf("Generating embeddings for page %d...\n", pageNum)
-                embeddings, err := p.generateEmbeddings(chunks)
-                if err != nil {
-                     log.Printf("❌ Embedding error page %d: %v", pageNum, err)
-                     // errChan <- fmt.Errorf("page %d embedding failed: %w", pageNum, err) 
-                     // Don't fail the whole job for one embedding error? Maybe better to log and continue
-                     // But for now, let's return error to be safe
-                     errChan <- err
-                     return
-                }
-                
-				fmt.Printf("Generated %d embeddings for page %d\n", len(embeddings), pageNum)
-
-				for idx, content := range chunks {
-					data := map[string]interface{}{
-						"document_id": doc.ID,
-						"page_number": pageNum,
-						"chunk_index": idx,
-						"content":     content,
-					}
-					if len(embeddings) > idx {
-					    data["embedding"] = embeddings[idx]
-					}
-					
-					chunkInserts = append(chunkInserts, data)
-				}
-
-				fmt.Printf("Inserting %d chunks for page %d...\n", len(chunkInserts), pageNum)
-				_, _, err = p.client.From("document_chunks").Insert(chunkInserts, false, "", "", "exact").Execute()
-				if err != nil {
-					log.Printf("❌ Failed to save chunks for page %d: %v", pageNum, err)
-					errChan <- fmt.Errorf("page %d chunk insertion failed: %w", pageNum, err)
-                    return
-				}
-				fmt.Printf("✅ Chunks inserted for page %d\n", pageNum)
-			}
-
-			// Update Progress
-			if pageNum%5 == 0 || pageNum == pageCount {
-				p.client.From("documents").Update(map[string]interface{}{"pages_done": pageNum}, "", "").Eq("id", doc.ID).Execute()
-			}
-
-		}(i)
-	}
-
-	wg.Wait()
-	close(errChan)
-
-	if len(errChan) > 0 {
-		return <-errChan 
-	}
-
-	return nil
-}
-
-// Replaced implementation with pure Go
-func (p *Processor) extractTextGo(path string, pageNum int) (string, error) {
-    // pdf.Open returns (file, reader, error)
-    pdfFile, r, err := pdf.Open(path)
-    if err != nil {
-        return "", err
-    }
-    defer pdfFile.Close()
-    
-    if pageNum > r.NumPage() {
-        return "", fmt.Errorf("page out of range")
-    }
-    
-    pObj := r.Page(pageNum)
-    content, err := pObj.GetPlainText(nil)
-    if err != nil {
-        return "", err 
-    }
-    return content, nil
-}
-
-// extractTextWithGemini uses Gemini 1.5 Flash to perform OCR on a single PDF page
-func (p *Processor) extractTextWithGemini(pdfPath string, pageNum int) (string, error) {
-    if p.genAIClient == nil {
-        return "", fmt.Errorf("genAI client not initialized")
-    }
-
-    // 1. Extract the single page to a temporary PDF file using pdfcpu
-    pageTempDir, err := os.MkdirTemp("", fmt.Sprintf("gemini_ocr_page_%d_", pageNum))
-    if err != nil {
-        return "", err
-    }
-    defer os.RemoveAll(pageTempDir)
-
-    conf := model.NewDefaultConfiguration()
-    // Extract single page
-    err = api.ExtractPagesFile(pdfPath, pageTempDir, []string{fmt.Sprintf("%d", pageNum)}, conf)
-    if err != nil {
-        return "", fmt.Errorf("failed to extract page %d: %w", pageNum, err)
-    }
-
-    // Find the extracted PDF file
-    files, _ := os.ReadDir(pageTempDir)
-    if len(files) == 0 {
-        return "", fmt.Errorf("no page file extracted")
-    }
-    pagePdfPath := filepath.Join(pageTempDir, files[0].Name())
-
-    // 2. Read PDF bytes
-    pdfBytes, err := os.ReadFile(pagePdfPath)
-    if err != nil {
-        return "", err
-    }
-
-    // 3. Call Gemini 2.5 Flash for OCR (Updated to verified working model)
-    model := p.genAIClient.GenerativeModel("gemini-2.5-flash")
-    
-    // Set a prompt optimized for Indonesian document OCR
-    prompt := "Ini adalah halaman dari dokumen peraturan PT KAI. Tolong ekstrak semua teks dari halaman ini secara akurat. Pertahankan struktur teks jika memungkinkan. Jangan tambahkan komentar apapun, hanya teks dari dokumen."
-    
-    ctx, cancel := context.WithTimeout(context.Background(), 1*time.Minute)
-    defer cancel()
-
-    resp, err := model.GenerateContent(ctx, 
-        genai.Text(prompt),
-        genai.Blob{MIMEType: "application/pdf", Data: pdfBytes},
-    )
-    if err != nil {
-        return "", fmt.Errorf("gemini error: %w", err)
-    }
-
-    if len(resp.Candidates) == 0 || len(resp.Candidates[0].Content.Parts) == 0 {
-        return "", fmt.Errorf("no text returned from gemini")
-    }
-
-    var result strings.Builder
-    for _, part := range resp.Candidates[0].Content.Parts {
-        if tex, ok := part.(genai.Text); ok {
-            result.WriteString(string(tex))
-        }
-    }
-
-    return strings.TrimSpace(result.String()), nil
-}
-
-// Removed extractTextWithOCR logic as it's replaced by Gemini-based OCR
-
-// isGarbageText detects if the text is filled with scrambled symbols (encoding issues)
-func (p *Processor) isGarbageText(text string) bool {
-    if len(text) == 0 {
-        return false
-    }
-    
-    // Count alphanumeric vs others
-    var alphaNum int
-    for _, r := range text {
-        if (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') || r == ' ' || r == '\n' || r == '\r' || r == '\t' {
-            alphaNum++
-        }
-    }
-    
-    ratio := float64(alphaNum) / float64(len(text))
-    // If less than 40% of characters are standard alphanumeric/whitespace, it's likely garbage encoding
-    return ratio < 0.4
-}
-
-// Removed legacy pdfcpu/ocr implementations
-
-
-func (p *Processor) chunkText(text string) []string {
-	const size = 1000 // Reduced specifically for embedding context window safety
-	const overlap = 100
-	var chunks []string
-
-	runes := []rune(text)
-	if len(runes) == 0 {
-		return chunks
-	}
-
-	for i := 0; i < len(runes); i += (size - overlap) {
-		end := i + size
-		if end > len(runes) {
-			end = len(runes)
-		}
-		chunks = append(chunks, string(runes[i:end]))
-		if end == len(runes) {
-			break
-		}
-	}
-	return chunks
-}
-
-func (p *Processor) generateEmbeddings(texts []string) ([][]float32, error) {
-    if p.genAIClient == nil {
-        return nil, fmt.Errorf("genAI client not initialized")
-    }
-    if len(texts) == 0 {
-        return nil, nil
-    }
-
-    model := p.genAIClient.EmbeddingModel("text-embedding-004")
-    batch := model.NewBatch()
-    for _, text := range texts {
-        batch.AddContent(genai.Text(text))
-    }
-    
-    ctx := context.Background()
-    resp, err := model.BatchEmbedContents(ctx, batch)
-    if err != nil {
-        return nil, err
-    }
-    
-    var results [][]float32
-    for _, e := range resp.Embeddings {
-        results = append(results, e.Values)
-    }
-    return results, nil
-}
+package processor
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/google/generative-ai-go/genai"
+	"github.com/supabase-community/supabase-go"
+	"google.golang.org/api/option"
+	"kai-worker/config"
+	"kai-worker/logging"
+	"kai-worker/metrics"
+	"kai-worker/rpc"
+)
+
+type Job struct {
+	ID             string     `json:"id"`
+	DocumentID     string     `json:"document_id"`
+	UserID         string     `json:"user_id"`
+	Status         string     `json:"status"`
+	Attempts       int        `json:"attempts"`
+	Kind           JobKind    `json:"kind"`
+	Params         JobParams  `json:"params"`
+	Priority       int        `json:"priority"`
+	LockedBy       string     `json:"locked_by"`
+	LeaseExpiresAt *time.Time `json:"lease_expires_at"`
+	NextAttemptAt  *time.Time `json:"next_attempt_at"`
+	ErrorCode      string     `json:"error_code"`
+	CreatedAt      time.Time  `json:"created_at"`
+}
+
+type Document struct {
+	ID          string `json:"id"`
+	StoragePath string `json:"storage_path"`
+}
+
+type Processor struct {
+	client      *supabase.Client
+	rpc         *rpc.Client
+	http        *http.Client
+	cfg         *config.Config
+	genAIClient *genai.Client
+
+	// extractSem and apiSem cap how much work all jobs in this process may do
+	// at once, so that several documents can share the CPU and the Gemini quota.
+	extractSem chan struct{}
+	apiSem     chan struct{}
+}
+
+func NewProcessor(client *supabase.Client, cfg *config.Config) *Processor {
+	// Initialize Gemini Client
+	ctx := context.Background()
+	genClient, err := genai.NewClient(ctx, option.WithAPIKey(cfg.Gemini.APIKey))
+	if err != nil {
+		slog.Warn("failed to create Gemini client", "error", err)
+	}
+
+	// Storage downloads are bounded by the download deadline as a whole;
+	// the HTTP timeout only limits how long the server may take to answer
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.ResponseHeaderTimeout = cfg.Timeouts.HTTP
+
+	return &Processor{
+		client:      client,
+		rpc:         rpc.New(cfg.Supabase.URL, cfg.Supabase.ServiceKey, cfg.Timeouts.HTTP),
+		http:        &http.Client{Transport: transport},
+		cfg:         cfg,
+		genAIClient: genClient,
+		extractSem:  make(chan struct{}, cfg.Worker.ExtractConcurrency),
+		apiSem:      make(chan struct{}, cfg.Worker.APIConcurrency),
+	}
+}
+
+// acquire takes a slot from sem, giving up if ctx is cancelled first.
+// The returned func releases the slot.
+func acquire(ctx context.Context, sem chan struct{}) (func(), error) {
+	select {
+	case sem <- struct{}{}:
+		return func() { <-sem }, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// GeminiReady reports whether the Gemini client was created, for readiness probes.
+func (p *Processor) GeminiReady(ctx context.Context) error {
+	if p.genAIClient == nil {
+		return fmt.Errorf("genAI client not initialized")
+	}
+	return nil
+}
+
+func (p *Processor) ProcessJob(ctx context.Context, job Job) (err error) {
+	ctx = logging.With(ctx, "job_id", job.ID, "document_id", job.DocumentID, "kind", string(job.Kind))
+	ctx, cancel := withDeadline(ctx, "job", p.cfg.Timeouts.Job)
+	defer cancel()
+	st := p.newStageTracker(job)
+	defer func() {
+		err = deadlineError(ctx, err)
+		var terr *TimeoutError
+		if errors.As(err, &terr) && terr.Scope == "job" {
+			terr.PagesCompleted = st.pagesCompleted()
+		}
+	}()
+	defer st.flush(ctx, job.Attempts)
+
+	// Folder jobs have no document of their own
+	if job.Kind == KindIngestFolder {
+		return p.ingestFolder(ctx, st, job)
+	}
+
+	// 1. Get Document Info
+	var docs []Document
+	_, err = p.client.From("documents").Select("*", "exact", false).Eq("id", job.DocumentID).ExecuteTo(&docs)
+	if err != nil {
+		return Transient(CodeDatabase, fmt.Errorf("fetch document: %w", err))
+	}
+	if len(docs) == 0 {
+		return Permanent(CodeDocumentNotFound, fmt.Errorf("document %s not found", job.DocumentID))
+	}
+	doc := docs[0]
+
+	switch job.Kind {
+	case KindIngest, "":
+		return p.ingest(ctx, st, doc)
+	case KindRechunk:
+		return p.rechunk(ctx, st, doc)
+	case KindReembed:
+		return p.reembed(ctx, st, doc, job.Params)
+	case KindReOCR:
+		return p.reocr(ctx, st, doc, job.Params)
+	case KindPurge:
+		return p.purge(ctx, st, doc)
+	default:
+		return Permanent(CodeUnknownKind, fmt.Errorf("unknown job kind %q", job.Kind))
+	}
+}
+
+// ingest downloads the document and fully processes it: extract (with OCR
+// fallback), chunk, embed and store every page.
+func (p *Processor) ingest(ctx context.Context, st *stageTracker, doc Document) error {
+	// 2. Download File
+	dctx, endDownload := st.begin(ctx, StageDownloading, 0)
+	localPath, err := p.download(dctx, doc)
+	endDownload()
+	if localPath != "" {
+		defer os.Remove(localPath)
+	}
+	if err != nil {
+		return err
+	}
+
+	mimeType, extractor, err := extractorFor(localPath)
+	if err != nil {
+		return err
+	}
+	ctx = logging.With(ctx, "mime_type", mimeType)
+	_, _, err = p.client.From("documents").Update(map[string]interface{}{"mime_type": mimeType}, "minimal", "").Eq("id", doc.ID).Execute()
+	if err != nil {
+		slog.WarnContext(ctx, "failed to record mime type", "error", err)
+	}
+
+	return p.processPages(ctx, st, doc, localPath, extractor)
+}
+
+// download fetches the document's file from Storage into a temp file and
+// returns its path. The caller removes the file.
+func (p *Processor) download(ctx context.Context, doc Document) (_ string, err error) {
+	ctx, cancel := withDeadline(ctx, "download", p.cfg.Timeouts.Download)
+	defer cancel()
+	defer func() { err = deadlineError(ctx, err) }()
+
+	downloadUrl := fmt.Sprintf("%s/storage/v1/object/%s/%s", p.cfg.Supabase.URL, p.cfg.Supabase.Bucket, doc.StoragePath)
+	req, err := http.NewRequestWithContext(ctx, "GET", downloadUrl, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Authorization", "Bearer "+p.cfg.Supabase.ServiceKey)
+
+	resp, err := p.http.Do(req)
+	if err != nil {
+		return "", Transient(CodeDownloadFailed, fmt.Errorf("download failed: %w", err))
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		b, _ := io.ReadAll(resp.Body)
+		return "", downloadError(resp.StatusCode, string(b))
+	}
+
+	// Detect Extension
+	ext := strings.ToLower(filepath.Ext(doc.StoragePath))
+	if ext == "" {
+		ext = ".pdf" // Default
+	}
+
+	// A unique name per download: another job for the same document may be
+	// reading its own copy
+	outFile, err := os.CreateTemp("", doc.ID+"-*"+ext)
+	if err != nil {
+		return "", err
+	}
+	localPath := outFile.Name()
+	_, err = io.Copy(outFile, resp.Body)
+	outFile.Close()
+	if err != nil {
+		return localPath, Transient(CodeDownloadFailed, fmt.Errorf("download failed: %w", err))
+	}
+	return localPath, nil
+}
+
+// downloadError classifies a non-200 response from Storage. Missing objects
+// won't appear on retry; everything else (5xx, auth hiccups) might.
+func downloadError(status int, body string) error {
+	err := fmt.Errorf("download error %d: %s", status, body)
+	switch {
+	case status == http.StatusNotFound,
+		status == http.StatusBadRequest && strings.Contains(strings.ToLower(body), "not found"):
+		return Permanent(CodeFileNotFound, err)
+	case status == http.StatusTooManyRequests:
+		return RateLimited(CodeDownloadFailed, err)
+	default:
+		return Transient(CodeDownloadFailed, err)
+	}
+}
+
+// processPages extracts every page of the file with extractor, OCRs the
+// pages that need it, and stores them.
+func (p *Processor) processPages(ctx context.Context, st *stageTracker, doc Document, localPath string, extractor Extractor) error {
+	src, err := p.open(ctx, extractor, localPath)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	pageCount := src.Count()
+
+	// Update total pages
+	_, _, err = p.client.From("documents").Update(map[string]interface{}{"pages_total": pageCount}, "", "").Eq("id", doc.ID).Execute()
+	if err != nil {
+		slog.WarnContext(ctx, "failed to update pages_total", "error", err)
+	}
+
+	// Drop pages beyond the end, e.g. left by an earlier version of the file
+	p.client.From("document_chunks").Delete("", "").Eq("document_id", doc.ID).Gt("page_number", fmt.Sprintf("%d", pageCount)).Execute()
+	p.client.From("document_pages").Delete("", "").Eq("document_id", doc.ID).Gt("page_number", fmt.Sprintf("%d", pageCount)).Execute()
+
+	// Pages an earlier attempt already finished are kept as they are
+	done, err := p.completedPages(ctx, doc.ID, st.jobID)
+	if err != nil {
+		slog.WarnContext(ctx, "failed to load page checkpoints; processing every page", "error", err)
+		done = nil
+	} else if len(done) > 0 {
+		slog.InfoContext(ctx, "resuming from page checkpoints", "pages_done", len(done), "pages_total", pageCount)
+	}
+
+	// Pages are processed one at a time within the job. Gemini calls are
+	// additionally capped process-wide by apiSem (the free tier allows 15 RPM),
+	// so other jobs' pages interleave with ours instead of waiting.
+	// A page that fails on its own (a timeout, a bad OCR answer) doesn't stop
+	// the rest: the retry only redoes the pages without a checkpoint. Quota
+	// and permanent errors would fail every page after it, so they end the
+	// job at once instead of spending more calls.
+	var firstErr error
+	for pageNum := 1; pageNum <= pageCount; pageNum++ {
+		ctx := logging.With(ctx, "page", pageNum)
+
+		// Don't start new pages once the job is cancelled (shutdown, lost lease)
+		if err := ctx.Err(); err != nil {
+			return deadlineError(ctx, fmt.Errorf("page %d skipped: %w", pageNum, err))
+		}
+
+		if done[pageNum] {
+			slog.DebugContext(ctx, "page already complete; skipping")
+			metrics.PagesResumed.Inc()
+			continue
+		}
+
+		if err := p.processPage(ctx, st, doc.ID, src, pageNum); err != nil {
+			slog.ErrorContext(ctx, "page failed", "error", err)
+			if kind := Classify(err).Kind; kind == KindRateLimited || kind == KindPermanent {
+				return err
+			}
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+
+		// Update Progress
+		if pageNum%5 == 0 {
+			p.client.From("documents").Update(map[string]interface{}{"pages_done": pageNum}, "", "").Eq("id", doc.ID).Execute()
+		}
+	}
+	if firstErr != nil {
+		return firstErr
+	}
+
+	p.finalize(ctx, st, doc, pageCount)
+	return nil
+}
+
+// open opens the file with extractor, holding an extraction slot while it
+// parses.
+func (p *Processor) open(ctx context.Context, extractor Extractor, localPath string) (PageSource, error) {
+	release, err := acquire(ctx, p.extractSem)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	return extractor.Open(ctx, localPath)
+}
+
+// processPage extracts, OCRs if needed, and stores one page within the
+// page deadline.
+func (p *Processor) processPage(ctx context.Context, st *stageTracker, documentID string, src PageSource, pageNum int) error {
+	ctx, cancel := withDeadline(ctx, "page", p.cfg.Timeouts.Page)
+	defer cancel()
+
+	ectx, endExtract := st.begin(ctx, StageExtracting, pageNum)
+	release, err := acquire(ectx, p.extractSem)
+	if err != nil {
+		endExtract()
+		return deadlineError(ectx, err)
+	}
+	page, err := src.Page(ectx, pageNum)
+	release()
+	endExtract()
+	if err != nil {
+		return deadlineError(ectx, err)
+	}
+
+	// Images always go to Gemini OCR. Otherwise it is a fallback: if empty,
+	// sparse (headers only), or contains garbage, try Gemini OCR
+	ocrSrc, canOCR := src.(ocrSource)
+	cleanedText := strings.TrimSpace(page.Text)
+	// The threshold catches "image-heavy" pages with just headers
+	if canOCR && (page.OCRRequired || page.OCRFallback && (len(cleanedText) < p.cfg.OCR.MinTextChars || p.isGarbageText(page.Text))) {
+		octx, endOCR := st.begin(ctx, StageOCR, pageNum)
+		reason := "insufficient_text"
+		switch {
+		case page.OCRRequired:
+			reason = "image"
+		case p.isGarbageText(page.Text):
+			reason = "garbage_text"
+		}
+		slog.InfoContext(octx, "falling back to Gemini OCR", "reason", reason, "chars", len(cleanedText))
+
+		ocrText, errOCR := p.ocrPage(octx, ocrSrc, pageNum)
+		endOCR()
+		if errOCR != nil {
+			slog.WarnContext(octx, "Gemini OCR failed", "error", errOCR)
+			metrics.OCRFallbacks.WithLabelValues("error").Inc()
+			if page.OCRRequired {
+				// Nothing to store without it; the retry redoes the page
+				return deadlineError(ctx, errOCR)
+			}
+		} else {
+			slog.InfoContext(octx, "Gemini OCR succeeded", "chars", len(ocrText))
+			metrics.OCRFallbacks.WithLabelValues("success").Inc()
+			page.Text = ocrText
+			page.Method = MethodOCR
+		}
+	}
+
+	return deadlineError(ctx, p.savePage(ctx, st, documentID, pageNum, page))
+}
+
+// savePage stores a page's text and replaces its chunks, then checkpoints
+// the page as complete.
+func (p *Processor) savePage(ctx context.Context, st *stageTracker, documentID string, pageNum int, page Page) error {
+	pageText := page.content()
+
+	// Save Page
+	// Delete existing data for idempotency (avoid upsert constraints issues)
+	pctx, endPersist := st.begin(ctx, StagePersisting, pageNum)
+	slog.DebugContext(pctx, "saving page", "chars", len(pageText))
+	p.client.From("document_pages").Delete("", "").Eq("document_id", documentID).Eq("page_number", fmt.Sprintf("%d", pageNum)).Execute()
+
+	_, _, err := p.client.From("document_pages").Insert(map[string]interface{}{
+		"document_id": documentID,
+		"page_number": pageNum,
+		"text":        pageText,
+		"method":      string(page.Method),
+		"metadata":    page.Metadata,
+	}, false, "", "", "exact").Execute()
+	endPersist()
+
+	if err != nil {
+		slog.ErrorContext(pctx, "failed to save page", "error", err)
+		return Transient(CodeDatabase, fmt.Errorf("page %d save failed: %w", pageNum, err))
+	}
+
+	chunkCount, err := p.replaceChunks(ctx, st, documentID, pageNum, pageText)
+	if err != nil {
+		return err
+	}
+	if err := p.markPageComplete(ctx, st, documentID, pageNum, pageText, chunkCount); err != nil {
+		return err
+	}
+	metrics.PagesProcessed.Inc()
+	return nil
+}
+
+// replaceChunks re-chunks and re-embeds a page's text, replacing any chunks
+// the page already had. It returns the number of chunks stored.
+func (p *Processor) replaceChunks(ctx context.Context, st *stageTracker, documentID string, pageNum int, pageText string) (int, error) {
+	// Chunking & Embeddings & Batch Insert
+	cctx, endChunk := st.begin(ctx, StageChunking, pageNum)
+	chunks := p.chunkText(pageText)
+	endChunk()
+	slog.DebugContext(cctx, "page chunked", "chunks", len(chunks))
+
+	var chunkInserts []map[string]interface{}
+	if len(chunks) > 0 {
+		// Generate embeddings
+		ectx, endEmbed := st.begin(ctx, StageEmbedding, pageNum)
+		embeddings, err := p.generateEmbeddings(ectx, chunks)
+		endEmbed()
+		if err != nil {
+			slog.ErrorContext(ectx, "embedding failed", "error", err)
+			return 0, err
+		}
+
+		slog.DebugContext(ectx, "embeddings generated", "count", len(embeddings))
+
+		for idx, content := range chunks {
+			data := map[string]interface{}{
+				"document_id": documentID,
+				"page_number": pageNum,
+				"chunk_index": idx,
+				"content":     content,
+			}
+			if len(embeddings) > idx {
+				data["embedding"] = embeddings[idx]
+			}
+
+			chunkInserts = append(chunkInserts, data)
+		}
+	}
+
+	// Swap old chunks for new only once the embeddings are in hand, so a
+	// failed embedding call doesn't leave the page unsearchable
+	pctx, endPersist := st.begin(ctx, StagePersisting, pageNum)
+	defer endPersist()
+	p.client.From("document_chunks").Delete("", "").Eq("document_id", documentID).Eq("page_number", fmt.Sprintf("%d", pageNum)).Execute()
+	if len(chunkInserts) == 0 {
+		return 0, nil
+	}
+
+	_, _, err := p.client.From("document_chunks").Insert(chunkInserts, false, "", "", "exact").Execute()
+	if err != nil {
+		slog.ErrorContext(pctx, "failed to save chunks", "error", err)
+		return 0, Transient(CodeDatabase, fmt.Errorf("page %d chunk insertion failed: %w", pageNum, err))
+	}
+	slog.DebugContext(pctx, "chunks saved", "chunks", len(chunkInserts))
+	return len(chunkInserts), nil
+}
+
+// finalize records the document's final page progress once every page is stored.
+func (p *Processor) finalize(ctx context.Context, st *stageTracker, doc Document, pagesDone int) {
+	ctx, end := st.begin(ctx, StageFinalizing, 0)
+	defer end()
+
+	_, _, err := p.client.From("documents").Update(map[string]interface{}{"pages_done": pagesDone}, "", "").Eq("id", doc.ID).Execute()
+	if err != nil {
+		slog.WarnContext(ctx, "failed to update pages_done", "error", err)
+	}
+}
+
+// ocrPage has Gemini read page pageNum of src.
+func (p *Processor) ocrPage(ctx context.Context, src ocrSource, pageNum int) (string, error) {
+	release, err := acquire(ctx, p.extractSem)
+	if err != nil {
+		return "", err
+	}
+	in, err := src.ocrInput(ctx, pageNum)
+	release()
+	if err != nil {
+		return "", err
+	}
+	return p.ocr(ctx, in)
+}
+
+// ocr uses Gemini to read the text in a page image or single-page PDF
+func (p *Processor) ocr(ctx context.Context, in ocrInput) (_ string, err error) {
+	defer func() { err = deadlineError(ctx, err) }()
+
+	if p.genAIClient == nil {
+		return "", fmt.Errorf("genAI client not initialized")
+	}
+
+	model := p.genAIClient.GenerativeModel(p.cfg.Gemini.OCRModel)
+
+	// Set a prompt optimized for Indonesian document OCR
+	prompt := "Ini adalah halaman dari dokumen peraturan PT KAI. Tolong ekstrak semua teks dari halaman ini secara akurat. Pertahankan struktur teks jika memungkinkan. Jangan tambahkan komentar apapun, hanya teks dari dokumen."
+
+	// Wait for an API slot before the timeout starts, so queueing behind
+	// other jobs doesn't eat into the call's budget
+	releaseAPI, err := acquire(ctx, p.apiSem)
+	if err != nil {
+		return "", err
+	}
+	defer releaseAPI()
+
+	callCtx, cancel := withDeadline(ctx, "ocr", p.cfg.Timeouts.OCR)
+	defer cancel()
+
+	resp, err := model.GenerateContent(callCtx,
+		genai.Text(prompt),
+		genai.Blob{MIMEType: in.MIMEType, Data: in.Data},
+	)
+	if err != nil {
+		return "", deadlineError(callCtx, geminiError(fmt.Errorf("gemini error: %w", err)))
+	}
+
+	if len(resp.Candidates) == 0 || len(resp.Candidates[0].Content.Parts) == 0 {
+		return "", fmt.Errorf("no text returned from gemini")
+	}
+
+	var result strings.Builder
+	for _, part := range resp.Candidates[0].Content.Parts {
+		if tex, ok := part.(genai.Text); ok {
+			result.WriteString(string(tex))
+		}
+	}
+
+	return strings.TrimSpace(result.String()), nil
+}
+
+// Removed extractTextWithOCR logic as it's replaced by Gemini-based OCR
+
+// isGarbageText detects if the text is filled with scrambled symbols (encoding issues)
+func (p *Processor) isGarbageText(text string) bool {
+	if len(text) == 0 {
+		return false
+	}
+
+	// Count alphanumeric vs others
+	var alphaNum int
+	for _, r := range text {
+		if (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') || r == ' ' || r == '\n' || r == '\r' || r == '\t' {
+			alphaNum++
+		}
+	}
+
+	ratio := float64(alphaNum) / float64(len(text))
+	// If less than 40% of characters are standard alphanumeric/whitespace, it's likely garbage encoding
+	return ratio < 0.4
+}
+
+// Removed legacy pdfcpu/ocr implementations
+
+func (p *Processor) chunkText(text string) []string {
+	size, overlap := p.cfg.Chunking.Size, p.cfg.Chunking.Overlap
+	var chunks []string
+
+	runes := []rune(text)
+	if len(runes) == 0 {
+		return chunks
+	}
+
+	for i := 0; i < len(runes); i += (size - overlap) {
+		end := i + size
+		if end > len(runes) {
+			end = len(runes)
+		}
+		chunks = append(chunks, string(runes[i:end]))
+		if end == len(runes) {
+			break
+		}
+	}
+	return chunks
+}
+
+// embedBatchSize is the most texts BatchEmbedContents accepts per call.
+const embedBatchSize = 100
+
+// generateEmbeddings embeds texts in order, in as many calls as it takes.
+// A large sheet or document can chunk into more than one call's worth.
+func (p *Processor) generateEmbeddings(ctx context.Context, texts []string) ([][]float32, error) {
+	var results [][]float32
+	for start := 0; start < len(texts); start += embedBatchSize {
+		end := min(start+embedBatchSize, len(texts))
+		batch, err := p.embedBatch(ctx, texts[start:end])
+		if err != nil {
+			return nil, err
+		}
+		if len(batch) != end-start {
+			return nil, Transient(CodeGeminiError, fmt.Errorf("got %d embeddings for %d texts", len(batch), end-start))
+		}
+		results = append(results, batch...)
+	}
+	return results, nil
+}
+
+func (p *Processor) embedBatch(ctx context.Context, texts []string) (_ [][]float32, err error) {
+	defer func() { err = deadlineError(ctx, err) }()
+
+	if p.genAIClient == nil {
+		return nil, fmt.Errorf("genAI client not initialized")
+	}
+	if len(texts) == 0 {
+		return nil, nil
+	}
+
+	model := p.genAIClient.EmbeddingModel(p.cfg.Gemini.EmbeddingModel)
+	batch := model.NewBatch()
+	for _, text := range texts {
+		batch.AddContent(genai.Text(text))
+	}
+
+	release, err := acquire(ctx, p.apiSem)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	// The deadline starts once we hold an API slot
+	callCtx, cancel := withDeadline(ctx, "embedding", p.cfg.Timeouts.Embedding)
+	defer cancel()
+
+	start := time.Now()
+	resp, err := model.BatchEmbedContents(callCtx, batch)
+	metrics.EmbeddingBatchSeconds.Observe(time.Since(start).Seconds())
+	if err != nil {
+		return nil, deadlineError(callCtx, geminiError(err))
+	}
+
+	var results [][]float32
+	for _, e := range resp.Embeddings {
+		results = append(results, e.Values)
+	}
+	return results, nil
+}
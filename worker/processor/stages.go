@@ -0,0 +1,145 @@
+package processor
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"time"
+
+	"kai-worker/logging"
+)
+
+// Stage is a step of the ingestion pipeline, written to jobs.stage.
+type Stage string
+
+const (
+	StageListing     Stage = "listing"
+	StageDownloading Stage = "downloading"
+	StageExtracting  Stage = "extracting"
+	StageOCR         Stage = "ocr"
+	StageChunking    Stage = "chunking"
+	StageEmbedding   Stage = "embedding"
+	StagePersisting  Stage = "persisting"
+	StageFinalizing  Stage = "finalizing"
+)
+
+// stageTracker records where a job currently is (jobs.stage, stage_page,
+// stage_started_at) and how long it spent in each stage overall. Page stages
+// repeat once per page, so durations are summed per stage and written to
+// job_stage_timings once, when the job ends.
+type stageTracker struct {
+	p          *Processor
+	jobID      string
+	documentID string
+
+	mu     sync.Mutex
+	order  []Stage
+	totals map[Stage]*stageTotal
+	pages  int // pages checkpointed by this run
+}
+
+type stageTotal struct {
+	startedAt  time.Time
+	finishedAt time.Time
+	elapsed    time.Duration
+	count      int
+}
+
+func (p *Processor) newStageTracker(job Job) *stageTracker {
+	return &stageTracker{
+		p:          p,
+		jobID:      job.ID,
+		documentID: job.DocumentID,
+		totals:     map[Stage]*stageTotal{},
+	}
+}
+
+// begin marks the job as being in stage (for page, or 0 for whole-document
+// stages). It returns ctx tagged with the stage and page for logging and
+// timeout errors, and a func that ends the stage. Call it as:
+//
+//	ctx, done := st.begin(ctx, StageOCR, pageNum)
+//	...
+//	done()
+func (t *stageTracker) begin(ctx context.Context, stage Stage, page int) (context.Context, func()) {
+	start := time.Now()
+	ctx = context.WithValue(ctx, stageKey{}, stageAt{stage: stage, page: page})
+	ctx = logging.With(ctx, "stage", string(stage))
+	if page > 0 {
+		ctx = logging.With(ctx, "page", page)
+	}
+
+	update := map[string]interface{}{
+		"stage":            string(stage),
+		"stage_page":       nil,
+		"stage_started_at": start,
+	}
+	if page > 0 {
+		update["stage_page"] = page
+	}
+	_, _, err := t.p.client.From("jobs").Update(update, "minimal", "").Eq("id", t.jobID).Execute()
+	if err != nil {
+		slog.WarnContext(ctx, "failed to record stage", "error", err)
+	}
+
+	return ctx, func() {
+		end := time.Now()
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		total, ok := t.totals[stage]
+		if !ok {
+			total = &stageTotal{startedAt: start}
+			t.totals[stage] = total
+			t.order = append(t.order, stage)
+		}
+		total.finishedAt = end
+		total.elapsed += end.Sub(start)
+		total.count++
+	}
+}
+
+// pageCompleted counts a page checkpointed by this run.
+func (t *stageTracker) pageCompleted() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.pages++
+}
+
+// pagesCompleted returns how many pages this run has checkpointed.
+func (t *stageTracker) pagesCompleted() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.pages
+}
+
+// flush writes the accumulated per-stage timings for this run of the job.
+func (t *stageTracker) flush(ctx context.Context, attempt int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if len(t.order) == 0 {
+		return
+	}
+
+	var rows []map[string]interface{}
+	for _, stage := range t.order {
+		total := t.totals[stage]
+		var documentID interface{} // folder jobs have none
+		if t.documentID != "" {
+			documentID = t.documentID
+		}
+		rows = append(rows, map[string]interface{}{
+			"job_id":      t.jobID,
+			"document_id": documentID,
+			"attempt":     attempt,
+			"stage":       string(stage),
+			"started_at":  total.startedAt,
+			"finished_at": total.finishedAt,
+			"duration_ms": total.elapsed.Milliseconds(),
+			"entries":     total.count,
+		})
+	}
+	_, _, err := t.p.client.From("job_stage_timings").Insert(rows, false, "", "minimal", "").Execute()
+	if err != nil {
+		slog.WarnContext(ctx, "failed to save stage timings", "error", err)
+	}
+}
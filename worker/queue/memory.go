@@ -0,0 +1,380 @@
+package queue
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"kai-worker/processor"
+)
+
+// Memory is an in-process Queue with the same claim order, lease, retry and
+// document status rules as the jobs table. It is meant for tests and local
+// runs; nothing is persisted.
+type Memory struct {
+	mu     sync.Mutex
+	lease  time.Duration
+	now    func() time.Time
+	nextID int
+
+	jobs  map[string]*memJob
+	order []string // insertion order, for stable scans
+	docs  map[string]string
+}
+
+type memJob struct {
+	job             processor.Job
+	lastError       string
+	errorKind       processor.ErrorKind
+	cancelRequested bool
+}
+
+// NewMemory returns an empty queue that leases claimed jobs for lease at a time.
+func NewMemory(lease time.Duration) *Memory {
+	return &Memory{
+		lease: lease,
+		now:   time.Now,
+		jobs:  map[string]*memJob{},
+		docs:  map[string]string{},
+	}
+}
+
+// SetClock replaces the time source, so tests can expire leases and
+// backoffs without sleeping.
+func (q *Memory) SetClock(now func() time.Time) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.now = now
+}
+
+// Enqueue adds job as queued and returns its ID, assigning one if job.ID is
+// empty. An ingest job's document is marked processing, as an upload would.
+func (q *Memory) Enqueue(job processor.Job) string {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if job.ID == "" {
+		q.nextID++
+		job.ID = fmt.Sprintf("job-%d", q.nextID)
+	}
+	if job.Kind == "" {
+		job.Kind = processor.KindIngest
+	}
+	if job.CreatedAt.IsZero() {
+		job.CreatedAt = q.now()
+	}
+	job.Status = "queued"
+	job.LockedBy = ""
+	job.LeaseExpiresAt = nil
+
+	if _, ok := q.jobs[job.ID]; !ok {
+		q.order = append(q.order, job.ID)
+	}
+	q.jobs[job.ID] = &memJob{job: job}
+	if job.DocumentID != "" && job.Kind.OwnsDocumentStatus() {
+		q.docs[job.DocumentID] = "processing"
+	}
+	return job.ID
+}
+
+// AddDocument records a document with the given status, e.g. one that is
+// already ready before a rechunk or reembed job is queued for it.
+func (q *Memory) AddDocument(documentID, status string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.docs[documentID] = status
+}
+
+// RequestCancel flags a job like cancel_document_jobs: queued jobs are
+// cancelled outright, processing ones are left for their worker to stop.
+func (q *Memory) RequestCancel(jobID string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if j, ok := q.jobs[jobID]; ok {
+		j.cancelRequested = true
+		if j.job.Status == "queued" {
+			j.lastError = "cancelled before it ran"
+			j.job.Status = "cancelled"
+			q.resetCancelled(j.job.DocumentID)
+		}
+	}
+}
+
+// DeleteDocument removes a document and, like the foreign key cascade, its jobs.
+func (q *Memory) DeleteDocument(documentID string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	delete(q.docs, documentID)
+	for id, j := range q.jobs {
+		if j.job.DocumentID == documentID {
+			delete(q.jobs, id)
+		}
+	}
+}
+
+// Job returns a copy of the job's current state.
+func (q *Memory) Job(jobID string) (processor.Job, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	j, ok := q.jobs[jobID]
+	if !ok {
+		return processor.Job{}, false
+	}
+	return j.job, true
+}
+
+// LastError returns the last recorded failure message and kind for a job.
+func (q *Memory) LastError(jobID string) (string, processor.ErrorKind) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if j, ok := q.jobs[jobID]; ok {
+		return j.lastError, j.errorKind
+	}
+	return "", ""
+}
+
+// DocumentStatus returns the document's status, or "" if it is unknown.
+func (q *Memory) DocumentStatus(documentID string) string {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.docs[documentID]
+}
+
+func (q *Memory) Claim(ctx context.Context, workerID string) (*processor.Job, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	now := q.now()
+
+	running := map[string]int{}
+	busy := map[string]bool{} // documents with a processing job
+	for _, j := range q.jobs {
+		if j.job.Status == "processing" {
+			running[j.job.UserID]++
+			busy[j.job.DocumentID] = true
+		}
+	}
+	var due []*memJob
+	for _, id := range q.order {
+		j, ok := q.jobs[id]
+		if !ok || j.job.Status != "queued" {
+			continue
+		}
+		if j.job.NextAttemptAt != nil && j.job.NextAttemptAt.After(now) {
+			continue
+		}
+		// Like claim_job, one processing job per document
+		if j.job.DocumentID != "" && busy[j.job.DocumentID] {
+			continue
+		}
+		due = append(due, j)
+	}
+	if len(due) == 0 {
+		return nil, nil
+	}
+
+	// Same order as claim_job: priority, then the user with the fewest
+	// running jobs, then round-robin across users, then oldest first
+	byUser := map[string][]*memJob{}
+	for _, j := range due {
+		byUser[j.job.UserID] = append(byUser[j.job.UserID], j)
+	}
+	userRank := map[*memJob]int{}
+	for _, jobs := range byUser {
+		sort.SliceStable(jobs, func(a, b int) bool {
+			if jobs[a].job.Priority != jobs[b].job.Priority {
+				return jobs[a].job.Priority > jobs[b].job.Priority
+			}
+			return jobs[a].job.CreatedAt.Before(jobs[b].job.CreatedAt)
+		})
+		for i, j := range jobs {
+			userRank[j] = i + 1
+		}
+	}
+	sort.SliceStable(due, func(a, b int) bool {
+		ja, jb := due[a].job, due[b].job
+		if ja.Priority != jb.Priority {
+			return ja.Priority > jb.Priority
+		}
+		if running[ja.UserID] != running[jb.UserID] {
+			return running[ja.UserID] < running[jb.UserID]
+		}
+		if userRank[due[a]] != userRank[due[b]] {
+			return userRank[due[a]] < userRank[due[b]]
+		}
+		return ja.CreatedAt.Before(jb.CreatedAt)
+	})
+
+	j := due[0]
+	expires := now.Add(q.lease)
+	j.job.Status = "processing"
+	j.job.LockedBy = workerID
+	j.job.LeaseExpiresAt = &expires
+	j.job.NextAttemptAt = nil
+	claimed := j.job
+	return &claimed, nil
+}
+
+func (q *Memory) Heartbeat(ctx context.Context, jobID, workerID string) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	j := q.held(jobID, workerID)
+	if j == nil {
+		return ErrLeaseLost
+	}
+	expires := q.now().Add(q.lease)
+	j.job.LeaseExpiresAt = &expires
+	return nil
+}
+
+func (q *Memory) Complete(ctx context.Context, job *processor.Job, workerID string) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	j := q.held(job.ID, workerID)
+	if j == nil {
+		return ErrLeaseLost
+	}
+	j.lastError, j.errorKind, j.job.ErrorCode = "", "", ""
+	q.release(j, "completed")
+	if _, ok := q.docs[job.DocumentID]; ok && job.Kind.OwnsDocumentStatus() {
+		q.docs[job.DocumentID] = "ready"
+	}
+	return nil
+}
+
+func (q *Memory) Fail(ctx context.Context, job *processor.Job, workerID string, err error) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	j := q.held(job.ID, workerID)
+	if j == nil {
+		return ErrLeaseLost
+	}
+	q.recordFailure(j, err)
+	q.release(j, "failed")
+	if _, ok := q.docs[job.DocumentID]; ok && job.Kind.OwnsDocumentStatus() {
+		q.docs[job.DocumentID] = "error"
+	}
+	return nil
+}
+
+func (q *Memory) Requeue(ctx context.Context, job *processor.Job, workerID string, err error, delay time.Duration) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	j := q.held(job.ID, workerID)
+	if j == nil {
+		return ErrLeaseLost
+	}
+	if err == nil {
+		j.lastError = "interrupted by worker shutdown"
+	} else {
+		q.recordFailure(j, err)
+		next := q.now().Add(delay)
+		if !processor.MadeProgress(err) {
+			j.job.Attempts = job.Attempts + 1
+		}
+		j.job.NextAttemptAt = &next
+	}
+	q.release(j, "queued")
+	return nil
+}
+
+func (q *Memory) Cancel(ctx context.Context, job *processor.Job, workerID string) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	j := q.held(job.ID, workerID)
+	if j == nil {
+		return ErrLeaseLost
+	}
+	j.lastError = "cancelled while processing"
+	q.release(j, "cancelled")
+	if job.Kind.OwnsDocumentStatus() {
+		q.resetCancelled(job.DocumentID)
+	}
+	return nil
+}
+
+func (q *Memory) CancelRequested(ctx context.Context, jobID string) (bool, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	j, ok := q.jobs[jobID]
+	return !ok || j.cancelRequested, nil
+}
+
+func (q *Memory) ReapExpired(ctx context.Context, maxAttempts int) ([]processor.Job, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	now := q.now()
+
+	var reaped []processor.Job
+	for _, id := range q.order {
+		j, ok := q.jobs[id]
+		if !ok || j.job.Status != "processing" || j.job.LeaseExpiresAt == nil || !j.job.LeaseExpiresAt.Before(now) {
+			continue
+		}
+
+		j.lastError = fmt.Sprintf("lease expired (worker %s stopped heartbeating)", j.job.LockedBy)
+		j.errorKind = processor.KindTransient
+		j.job.ErrorCode = "lease_expired"
+		if j.job.Attempts+1 < maxAttempts {
+			j.job.Attempts++
+			q.release(j, "queued")
+		} else {
+			q.release(j, "failed")
+			if _, ok := q.docs[j.job.DocumentID]; ok && j.job.Kind.OwnsDocumentStatus() {
+				q.docs[j.job.DocumentID] = "error"
+			}
+		}
+		reaped = append(reaped, j.job)
+	}
+	return reaped, nil
+}
+
+func (q *Memory) Depth(ctx context.Context) (int, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	n := 0
+	for _, j := range q.jobs {
+		if j.job.Status == "queued" {
+			n++
+		}
+	}
+	return n, nil
+}
+
+// held returns the job if it exists and is leased to workerID.
+func (q *Memory) held(jobID, workerID string) *memJob {
+	j, ok := q.jobs[jobID]
+	if !ok || j.job.Status != "processing" || j.job.LockedBy != workerID {
+		return nil
+	}
+	return j
+}
+
+// resetCancelled sets a processing document to error once no ingest job
+// for it is queued or running, like reset_cancelled_document.
+func (q *Memory) resetCancelled(documentID string) {
+	if q.docs[documentID] != "processing" {
+		return
+	}
+	for _, j := range q.jobs {
+		if j.job.DocumentID == documentID && j.job.Kind.OwnsDocumentStatus() &&
+			(j.job.Status == "queued" || j.job.Status == "processing") {
+			return
+		}
+	}
+	q.docs[documentID] = "error"
+}
+
+func (q *Memory) release(j *memJob, status string) {
+	j.job.Status = status
+	j.job.LockedBy = ""
+	j.job.LeaseExpiresAt = nil
+}
+
+func (q *Memory) recordFailure(j *memJob, err error) {
+	perr := processor.Classify(err)
+	j.lastError = err.Error()
+	j.errorKind = perr.Kind
+	j.job.ErrorCode = perr.Code
+}
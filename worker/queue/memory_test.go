@@ -0,0 +1,298 @@
+package queue
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"kai-worker/processor"
+)
+
+var epoch = time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// clock is a settable time source for Memory.SetClock.
+type clock struct{ t time.Time }
+
+func (c *clock) now() time.Time          { return c.t }
+func (c *clock) advance(d time.Duration) { c.t = c.t.Add(d) }
+
+func newTestQueue(t *testing.T) (*Memory, *clock) {
+	t.Helper()
+	c := &clock{t: epoch}
+	q := NewMemory(time.Minute)
+	q.SetClock(c.now)
+	return q, c
+}
+
+func claim(t *testing.T, q *Memory, workerID string) *processor.Job {
+	t.Helper()
+	job, err := q.Claim(context.Background(), workerID)
+	if err != nil {
+		t.Fatalf("Claim: %v", err)
+	}
+	return job
+}
+
+func claimID(t *testing.T, q *Memory, workerID string) string {
+	t.Helper()
+	job := claim(t, q, workerID)
+	if job == nil {
+		t.Fatal("Claim returned no job")
+	}
+	return job.ID
+}
+
+func TestClaimOrder(t *testing.T) {
+	q, _ := newTestQueue(t)
+	at := func(min int) time.Time { return epoch.Add(time.Duration(min) * time.Minute) }
+
+	// alice queued two jobs before bob's one; carol's is urgent but newest
+	q.Enqueue(processor.Job{ID: "alice-1", DocumentID: "d1", UserID: "alice", CreatedAt: at(1)})
+	q.Enqueue(processor.Job{ID: "alice-2", DocumentID: "d2", UserID: "alice", CreatedAt: at(2)})
+	q.Enqueue(processor.Job{ID: "bob-1", DocumentID: "d3", UserID: "bob", CreatedAt: at(3)})
+	q.Enqueue(processor.Job{ID: "carol-1", DocumentID: "d4", UserID: "carol", CreatedAt: at(4), Priority: 100})
+
+	// Priority first, then the user with fewer running jobs, then
+	// round-robin, then age
+	want := []string{"carol-1", "alice-1", "bob-1", "alice-2"}
+	for i, id := range want {
+		if got := claimID(t, q, "w"); got != id {
+			t.Fatalf("claim %d = %s, want %s", i+1, got, id)
+		}
+	}
+	if job := claim(t, q, "w"); job != nil {
+		t.Fatalf("claimed %s from an empty queue", job.ID)
+	}
+}
+
+func TestClaimOneJobPerDocument(t *testing.T) {
+	q, _ := newTestQueue(t)
+	q.Enqueue(processor.Job{ID: "ingest", DocumentID: "d1", UserID: "u", CreatedAt: epoch})
+	q.Enqueue(processor.Job{ID: "reocr", DocumentID: "d1", UserID: "u", CreatedAt: epoch.Add(time.Second), Kind: processor.KindReOCR})
+
+	claimID(t, q, "w1")
+	if job := claim(t, q, "w2"); job != nil {
+		t.Fatalf("claimed %s while its document had a processing job", job.ID)
+	}
+	if err := q.Complete(context.Background(), &processor.Job{ID: "ingest", DocumentID: "d1"}, "w1"); err != nil {
+		t.Fatal(err)
+	}
+	if got := claimID(t, q, "w2"); got != "reocr" {
+		t.Fatalf("claimed %s, want reocr", got)
+	}
+}
+
+func TestRequeueBackoff(t *testing.T) {
+	q, c := newTestQueue(t)
+	ctx := context.Background()
+	q.Enqueue(processor.Job{ID: "j", DocumentID: "d", UserID: "u"})
+
+	job := claim(t, q, "w")
+	failure := processor.Transient(processor.CodeGeminiError, errors.New("503"))
+	if err := q.Requeue(ctx, job, "w", failure, 5*time.Minute); err != nil {
+		t.Fatal(err)
+	}
+
+	got, _ := q.Job("j")
+	if got.Status != "queued" || got.Attempts != 1 || got.ErrorCode != processor.CodeGeminiError {
+		t.Fatalf("after requeue: status=%s attempts=%d code=%s", got.Status, got.Attempts, got.ErrorCode)
+	}
+	if got.NextAttemptAt == nil || !got.NextAttemptAt.Equal(epoch.Add(5*time.Minute)) {
+		t.Fatalf("next_attempt_at = %v, want %v", got.NextAttemptAt, epoch.Add(5*time.Minute))
+	}
+
+	c.advance(5*time.Minute - time.Second)
+	if job := claim(t, q, "w"); job != nil {
+		t.Fatal("claimed a job before its backoff passed")
+	}
+	c.advance(time.Second)
+	if got := claimID(t, q, "w"); got != "j" {
+		t.Fatalf("claimed %s, want j", got)
+	}
+}
+
+func TestShutdownRequeueCountsNoAttempt(t *testing.T) {
+	q, _ := newTestQueue(t)
+	q.Enqueue(processor.Job{ID: "j", DocumentID: "d", UserID: "u"})
+
+	job := claim(t, q, "w")
+	if err := q.Requeue(context.Background(), job, "w", nil, 0); err != nil {
+		t.Fatal(err)
+	}
+	got, _ := q.Job("j")
+	if got.Status != "queued" || got.Attempts != 0 || got.NextAttemptAt != nil {
+		t.Fatalf("status=%s attempts=%d next=%v, want queued, 0 attempts, due now", got.Status, got.Attempts, got.NextAttemptAt)
+	}
+}
+
+func TestLeaseLost(t *testing.T) {
+	q, c := newTestQueue(t)
+	ctx := context.Background()
+	q.Enqueue(processor.Job{ID: "j", DocumentID: "d", UserID: "u"})
+
+	job := claim(t, q, "w1")
+	if err := q.Heartbeat(ctx, "j", "w1"); err != nil {
+		t.Fatalf("Heartbeat while holding the lease: %v", err)
+	}
+
+	// w1 stalls past its lease; the reaper hands the job to w2
+	c.advance(2 * time.Minute)
+	if _, err := q.ReapExpired(ctx, 3); err != nil {
+		t.Fatal(err)
+	}
+	claimID(t, q, "w2")
+
+	if err := q.Heartbeat(ctx, "j", "w1"); !errors.Is(err, ErrLeaseLost) {
+		t.Fatalf("Heartbeat after losing the lease = %v, want ErrLeaseLost", err)
+	}
+	// w1's late outcome must not touch w2's run, or the document
+	if err := q.Fail(ctx, job, "w1", errors.New("late")); !errors.Is(err, ErrLeaseLost) {
+		t.Fatalf("Fail after losing the lease = %v, want ErrLeaseLost", err)
+	}
+	if err := q.Complete(ctx, job, "w1"); !errors.Is(err, ErrLeaseLost) {
+		t.Fatalf("Complete after losing the lease = %v, want ErrLeaseLost", err)
+	}
+	got, _ := q.Job("j")
+	if got.Status != "processing" || got.LockedBy != "w2" {
+		t.Fatalf("status=%s locked_by=%s, want processing by w2", got.Status, got.LockedBy)
+	}
+	if status := q.DocumentStatus("d"); status != "processing" {
+		t.Fatalf("document status = %s, want processing", status)
+	}
+}
+
+func TestReapToFailed(t *testing.T) {
+	q, c := newTestQueue(t)
+	ctx := context.Background()
+	q.Enqueue(processor.Job{ID: "j", DocumentID: "d", UserID: "u"})
+
+	// Two runs allowed: the first expiry requeues, the second fails
+	for run, want := range []string{"queued", "failed"} {
+		claimID(t, q, "w")
+		c.advance(2 * time.Minute)
+		reaped, err := q.ReapExpired(ctx, 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(reaped) != 1 || reaped[0].Status != want {
+			t.Fatalf("run %d: reaped %+v, want one %s job", run+1, reaped, want)
+		}
+	}
+
+	got, _ := q.Job("j")
+	if got.Attempts != 1 || got.ErrorCode != "lease_expired" {
+		t.Fatalf("attempts=%d code=%s, want 1 and lease_expired", got.Attempts, got.ErrorCode)
+	}
+	if status := q.DocumentStatus("d"); status != "error" {
+		t.Fatalf("document status = %s, want error", status)
+	}
+}
+
+func TestDocumentStatus(t *testing.T) {
+	ctx := context.Background()
+	tests := []struct {
+		name   string
+		kind   processor.JobKind
+		before string // document status when the job is queued
+		fail   bool
+		want   string
+	}{
+		{"ingest completed", processor.KindIngest, "uploading", false, "ready"},
+		{"ingest failed", processor.KindIngest, "uploading", true, "error"},
+		{"rechunk completed", processor.KindRechunk, "ready", false, "ready"},
+		{"purge completed", processor.KindPurge, "ready", false, "ready"},
+		{"reocr failed", processor.KindReOCR, "ready", true, "ready"},
+		{"reembed failed", processor.KindReembed, "ready", true, "ready"},
+		{"reembed completed on a failed document", processor.KindReembed, "error", false, "error"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q, _ := newTestQueue(t)
+			q.AddDocument("d", tt.before)
+			q.Enqueue(processor.Job{ID: "j", DocumentID: "d", UserID: "u", Kind: tt.kind})
+			if tt.kind == processor.KindIngest {
+				if status := q.DocumentStatus("d"); status != "processing" {
+					t.Fatalf("document status after enqueue = %s, want processing", status)
+				}
+			}
+
+			job := claim(t, q, "w")
+			var err error
+			if tt.fail {
+				err = q.Fail(ctx, job, "w", processor.Permanent(processor.CodeInvalidPDF, errors.New("bad")))
+			} else {
+				err = q.Complete(ctx, job, "w")
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if status := q.DocumentStatus("d"); status != tt.want {
+				t.Fatalf("document status = %s, want %s", status, tt.want)
+			}
+		})
+	}
+}
+
+func TestCancelResetsDocument(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("queued job", func(t *testing.T) {
+		q, _ := newTestQueue(t)
+		q.Enqueue(processor.Job{ID: "j", DocumentID: "d", UserID: "u"})
+		q.RequestCancel("j")
+		if status := q.DocumentStatus("d"); status != "error" {
+			t.Fatalf("document status = %s, want error", status)
+		}
+	})
+
+	t.Run("running job with another ingest queued", func(t *testing.T) {
+		q, _ := newTestQueue(t)
+		q.Enqueue(processor.Job{ID: "old", DocumentID: "d", UserID: "u", CreatedAt: epoch})
+		job := claim(t, q, "w")
+		q.Enqueue(processor.Job{ID: "new", DocumentID: "d", UserID: "u", CreatedAt: epoch.Add(time.Second)})
+
+		q.RequestCancel("old")
+		if err := q.Cancel(ctx, job, "w"); err != nil {
+			t.Fatal(err)
+		}
+		if status := q.DocumentStatus("d"); status != "processing" {
+			t.Fatalf("document status = %s, want processing for the queued ingest", status)
+		}
+		if msg, _ := q.LastError("old"); msg == "" {
+			t.Fatal("cancelled job has no reason recorded")
+		}
+	})
+
+	t.Run("reembed job", func(t *testing.T) {
+		q, _ := newTestQueue(t)
+		q.AddDocument("d", "ready")
+		q.Enqueue(processor.Job{ID: "j", DocumentID: "d", UserID: "u", Kind: processor.KindReembed})
+		job := claim(t, q, "w")
+		if err := q.Cancel(ctx, job, "w"); err != nil {
+			t.Fatal(err)
+		}
+		if status := q.DocumentStatus("d"); status != "ready" {
+			t.Fatalf("document status = %s, want ready", status)
+		}
+	})
+}
+
+func TestCompleteClearsFailure(t *testing.T) {
+	q, _ := newTestQueue(t)
+	ctx := context.Background()
+	q.Enqueue(processor.Job{ID: "j", DocumentID: "d", UserID: "u"})
+
+	job := claim(t, q, "w")
+	q.Requeue(ctx, job, "w", processor.Transient(processor.CodeDatabase, errors.New("timeout")), 0)
+	job = claim(t, q, "w")
+	if err := q.Complete(ctx, job, "w"); err != nil {
+		t.Fatal(err)
+	}
+
+	got, _ := q.Job("j")
+	msg, kind := q.LastError("j")
+	if got.ErrorCode != "" || msg != "" || kind != "" {
+		t.Fatalf("completed job kept its failure: code=%q error=%q kind=%q", got.ErrorCode, msg, kind)
+	}
+}
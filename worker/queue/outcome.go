@@ -0,0 +1,132 @@
+package queue
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"time"
+
+	"kai-worker/metrics"
+	"kai-worker/processor"
+	"kai-worker/webhook"
+)
+
+// Causes attached to a job's context when it is stopped early. A lost lease
+// uses ErrLeaseLost.
+var (
+	ErrShutdown  = errors.New("worker shutting down")
+	ErrCancelled = errors.New("job cancelled")
+)
+
+// Emitter reports job events; *webhook.Dispatcher sends them as webhooks.
+type Emitter interface {
+	Emit(ctx context.Context, eventType string, job *processor.Job, failure error)
+}
+
+// RetryPolicy decides whether and when a failed job runs again.
+type RetryPolicy struct {
+	// MaxAttempts is how many times a job runs, the first run included.
+	MaxAttempts int
+	// Delay returns the backoff before retry number attempt+1.
+	Delay func(attempt int) time.Duration
+}
+
+// Settle records how one run of job ended and returns the status it left
+// the job in, or "" if the job isn't ours to touch any more; then neither
+// the document nor hooks hear about the run. err is what
+// processing returned; cause is why the run's context was cancelled, if it
+// was (ErrShutdown, ErrCancelled or ErrLeaseLost).
+//
+// A run stopped early isn't the document's fault and counts no attempt, nor
+// does a run the job deadline cut off after it checkpointed pages: it
+// resumes at once. Otherwise permanent errors fail the job at once, other
+// errors are retried with backoff until policy.MaxAttempts runs are used
+// up, and success completes it. For kinds that own the document's status, failures and
+// completions are reported to hooks.
+func Settle(ctx context.Context, q Queue, hooks Emitter, workerID string, policy RetryPolicy, job *processor.Job, err, cause error) string {
+	if err != nil && cause != nil {
+		slog.WarnContext(ctx, "Job stopped early", "cause", cause, "error", err)
+		var status string
+		var releaseErr error
+		switch {
+		case errors.Is(cause, ErrCancelled):
+			status = "cancelled"
+			releaseErr = q.Cancel(ctx, job, workerID)
+		case errors.Is(cause, ErrLeaseLost):
+			// Someone else owns the row now; leave it alone
+		default:
+			status = "queued"
+			releaseErr = q.Requeue(ctx, job, workerID, nil, 0)
+		}
+		switch {
+		case errors.Is(releaseErr, ErrLeaseLost):
+			slog.WarnContext(ctx, "Job is no longer ours to release")
+			return ""
+		case releaseErr != nil:
+			slog.ErrorContext(ctx, "Failed to release job", "error", releaseErr)
+		}
+		return status
+	}
+
+	status := "completed"
+	jobErr := err
+	if err != nil {
+		perr := processor.Classify(err)
+		slog.ErrorContext(ctx, "Job failed", "error_kind", string(perr.Kind), "error_code", perr.Code, "error", err)
+
+		switch {
+		case perr.Kind == processor.KindPermanent:
+			// Retrying won't help: dead-letter the job right away
+			status = "failed"
+			err = q.Fail(ctx, job, workerID, err)
+		case processor.MadeProgress(err):
+			// The document is bigger than one run of the job deadline, not
+			// broken: carry on from the checkpoints
+			status = "queued"
+			slog.InfoContext(ctx, "Job will resume from its checkpoints", "attempt", job.Attempts+1,
+				"max_attempts", policy.MaxAttempts)
+			err = q.Requeue(ctx, job, workerID, err, 0)
+		case job.Attempts+1 < policy.MaxAttempts:
+			// Attempts counts earlier runs, so this was run Attempts+1.
+			// Re-queue after backoff; quota errors wait longer
+			status = "queued"
+			backoff := job.Attempts
+			if perr.Kind == processor.KindRateLimited {
+				backoff += 2
+			}
+			delay := policy.Delay(backoff)
+			slog.InfoContext(ctx, "Job will be retried", "delay", delay.Round(time.Second),
+				"next_attempt", job.Attempts+2, "max_attempts", policy.MaxAttempts)
+			err = q.Requeue(ctx, job, workerID, err, delay)
+		default:
+			status = "failed"
+			err = q.Fail(ctx, job, workerID, err)
+		}
+		metrics.JobsFailed.WithLabelValues(string(perr.Kind), status).Inc()
+	} else {
+		metrics.JobsCompleted.Inc()
+		err = q.Complete(ctx, job, workerID)
+	}
+
+	switch {
+	case errors.Is(err, ErrLeaseLost):
+		// Another worker has the job now; this run's outcome doesn't count
+		slog.WarnContext(ctx, "Lost lease before recording the outcome", "status", status)
+		return ""
+	case err != nil:
+		slog.ErrorContext(ctx, "Failed to update final job status", "status", status, "error", err)
+		return status
+	}
+	slog.InfoContext(ctx, "Job finished", "status", status)
+
+	if !job.Kind.OwnsDocumentStatus() {
+		return status // the job's error is on the job; the document is unchanged
+	}
+	switch status {
+	case "completed":
+		hooks.Emit(ctx, webhook.DocumentReady, job, nil)
+	case "failed":
+		hooks.Emit(ctx, webhook.DocumentFailed, job, jobErr)
+	}
+	return status
+}
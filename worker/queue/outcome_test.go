@@ -0,0 +1,215 @@
+package queue
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"testing"
+	"time"
+
+	"kai-worker/processor"
+	"kai-worker/webhook"
+)
+
+// recorder is an Emitter that remembers the events it was given.
+type recorder struct{ events []string }
+
+func (r *recorder) Emit(ctx context.Context, eventType string, job *processor.Job, failure error) {
+	r.events = append(r.events, eventType)
+}
+
+// settleRun claims the queue's only job, as it stands, and settles a run of
+// it that ended with err and cause.
+func settleRun(t *testing.T, q *Memory, hooks Emitter, policy RetryPolicy, err, cause error) (*processor.Job, string) {
+	t.Helper()
+	job := claim(t, q, "w")
+	if job == nil {
+		t.Fatal("nothing to claim")
+	}
+	return job, Settle(context.Background(), q, hooks, "w", policy, job, err, cause)
+}
+
+// jobDeadline is the error of a run cut off by the job deadline after it
+// checkpointed pages pages.
+func jobDeadline(pages int) error {
+	return processor.Transient(processor.CodeTimeout, &processor.TimeoutError{
+		Scope: "job", Limit: time.Hour, PagesCompleted: pages, Err: context.DeadlineExceeded,
+	})
+}
+
+func TestSettle(t *testing.T) {
+	transient := processor.Transient(processor.CodeGeminiError, errors.New("503"))
+	tests := []struct {
+		name     string
+		kind     processor.JobKind
+		attempts int // runs before this one
+		err      error
+		cause    error
+		stolen   bool // another worker took the job over before Settle
+
+		wantStatus   string // returned by Settle
+		wantJob      string // jobs.status afterwards
+		wantAttempts int
+		wantDoc      string
+		wantEvents   []string
+	}{
+		{
+			name:       "success",
+			wantStatus: "completed", wantJob: "completed", wantDoc: "ready",
+			wantEvents: []string{webhook.DocumentReady},
+		},
+		{
+			name:       "transient error with runs left",
+			err:        transient,
+			wantStatus: "queued", wantJob: "queued", wantAttempts: 1, wantDoc: "processing",
+		},
+		{
+			name:     "transient error on the last run",
+			attempts: 2, err: transient,
+			wantStatus: "failed", wantJob: "failed", wantAttempts: 2, wantDoc: "error",
+			wantEvents: []string{webhook.DocumentFailed},
+		},
+		{
+			name:     "job deadline after checkpointing pages",
+			attempts: 2, err: jobDeadline(3),
+			wantStatus: "queued", wantJob: "queued", wantAttempts: 2, wantDoc: "processing",
+		},
+		{
+			name:     "job deadline without progress",
+			attempts: 2, err: jobDeadline(0),
+			wantStatus: "failed", wantJob: "failed", wantAttempts: 2, wantDoc: "error",
+			wantEvents: []string{webhook.DocumentFailed},
+		},
+		{
+			name:       "permanent error",
+			err:        processor.Permanent(processor.CodeInvalidPDF, errors.New("bad xref")),
+			wantStatus: "failed", wantJob: "failed", wantDoc: "error",
+			wantEvents: []string{webhook.DocumentFailed},
+		},
+		{
+			name:       "reembed failure leaves the document alone",
+			kind:       processor.KindReembed,
+			err:        processor.Permanent(processor.CodeInvalidPDF, errors.New("bad")),
+			wantStatus: "failed", wantJob: "failed", wantDoc: "ready",
+		},
+		{
+			name: "cancelled",
+			err:  context.Canceled, cause: ErrCancelled,
+			wantStatus: "cancelled", wantJob: "cancelled", wantDoc: "error",
+		},
+		{
+			name:     "shutdown",
+			attempts: 1,
+			err:      context.Canceled, cause: ErrShutdown,
+			wantStatus: "queued", wantJob: "queued", wantAttempts: 1, wantDoc: "processing",
+		},
+		{
+			name: "lease lost",
+			err:  context.Canceled, cause: ErrLeaseLost,
+			wantStatus: "", wantJob: "processing", wantDoc: "processing",
+		},
+		{
+			name:   "failure after the lease was lost",
+			err:    processor.Permanent(processor.CodeInvalidPDF, errors.New("bad xref")),
+			stolen: true,
+			// The reaper's requeue counted the attempt, not this run
+			wantStatus: "", wantJob: "processing", wantAttempts: 1, wantDoc: "processing",
+		},
+		{
+			name:       "success after the lease was lost",
+			stolen:     true,
+			wantStatus: "", wantJob: "processing", wantAttempts: 1, wantDoc: "processing",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			q, c := newTestQueue(t)
+			// Ingest jobs mark it processing when queued
+			q.AddDocument("d", "ready")
+			q.Enqueue(processor.Job{ID: "j", DocumentID: "d", UserID: "u", Kind: tt.kind, Attempts: tt.attempts})
+			hooks := &recorder{}
+			policy := RetryPolicy{MaxAttempts: 3, Delay: func(int) time.Duration { return time.Minute }}
+
+			job := claim(t, q, "w")
+			if tt.stolen {
+				c.advance(2 * time.Minute)
+				if _, err := q.ReapExpired(ctx, policy.MaxAttempts); err != nil {
+					t.Fatal(err)
+				}
+				claimID(t, q, "w2")
+			}
+			status := Settle(ctx, q, hooks, "w", policy, job, tt.err, tt.cause)
+			if status != tt.wantStatus {
+				t.Errorf("Settle = %q, want %q", status, tt.wantStatus)
+			}
+			got, _ := q.Job("j")
+			if got.Status != tt.wantJob || got.Attempts != tt.wantAttempts {
+				t.Errorf("job status=%s attempts=%d, want %s and %d", got.Status, got.Attempts, tt.wantJob, tt.wantAttempts)
+			}
+			if doc := q.DocumentStatus("d"); doc != tt.wantDoc {
+				t.Errorf("document status = %s, want %s", doc, tt.wantDoc)
+			}
+			if !slices.Equal(hooks.events, tt.wantEvents) {
+				t.Errorf("events = %v, want %v", hooks.events, tt.wantEvents)
+			}
+		})
+	}
+}
+
+// MaxAttempts counts runs: with 3, a job that keeps failing runs 3 times.
+func TestSettleMaxAttemptsCountsRuns(t *testing.T) {
+	q, c := newTestQueue(t)
+	q.Enqueue(processor.Job{ID: "j", DocumentID: "d", UserID: "u"})
+	policy := RetryPolicy{MaxAttempts: 3, Delay: func(int) time.Duration { return time.Minute }}
+	failure := errors.New("unclassified")
+
+	runs := 0
+	for {
+		_, status := settleRun(t, q, &recorder{}, policy, failure, nil)
+		runs++
+		if status == "failed" {
+			break
+		}
+		if runs > 3 {
+			t.Fatal("job still retried after 3 runs")
+		}
+		c.advance(time.Minute)
+	}
+	if runs != 3 {
+		t.Fatalf("job failed after %d runs, want 3", runs)
+	}
+}
+
+func TestSettleBackoff(t *testing.T) {
+	tests := []struct {
+		name     string
+		attempts int
+		err      error
+		want     int // attempt number passed to Delay
+	}{
+		{"first retry", 0, processor.Transient(processor.CodeDatabase, errors.New("reset")), 0},
+		{"second retry", 1, processor.Transient(processor.CodeDatabase, errors.New("reset")), 1},
+		{"quota waits longer", 0, processor.RateLimited(processor.CodeGeminiQuota, errors.New("429")), 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q, _ := newTestQueue(t)
+			q.Enqueue(processor.Job{ID: "j", DocumentID: "d", UserID: "u", Attempts: tt.attempts})
+			var gotAttempt int
+			policy := RetryPolicy{MaxAttempts: 5, Delay: func(attempt int) time.Duration {
+				gotAttempt = attempt
+				return 10 * time.Minute
+			}}
+
+			settleRun(t, q, &recorder{}, policy, tt.err, nil)
+			if gotAttempt != tt.want {
+				t.Errorf("Delay called with %d, want %d", gotAttempt, tt.want)
+			}
+			got, _ := q.Job("j")
+			if got.NextAttemptAt == nil || !got.NextAttemptAt.Equal(epoch.Add(10*time.Minute)) {
+				t.Errorf("next_attempt_at = %v, want %v", got.NextAttemptAt, epoch.Add(10*time.Minute))
+			}
+		})
+	}
+}
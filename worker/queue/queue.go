@@ -0,0 +1,67 @@
+// Package queue is the worker's view of the job queue: claiming jobs under a
+// lease, keeping the lease alive and recording how each job ended, including
+// the matching document status. Supabase is the production implementation;
+// Memory runs the same state machine in process, without a database.
+// Settle turns the result of a run into the retry, dead-letter or cancel
+// decision, so those rules can be tested against Memory.
+package queue
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"kai-worker/processor"
+)
+
+// ErrLeaseLost is returned when the job is no longer leased to the worker,
+// e.g. because the reaper handed it to another replica.
+var ErrLeaseLost = errors.New("lease lost")
+
+// Queue hands out jobs to workers. Every method that changes a job only does
+// so while workerID still holds its lease; otherwise it changes nothing,
+// the document included, and returns ErrLeaseLost.
+type Queue interface {
+	// Claim moves the next due queued job (by priority, then fair share
+	// across users) to processing and leases it to workerID. It returns nil
+	// when there is nothing to do.
+	Claim(ctx context.Context, workerID string) (*processor.Job, error)
+
+	// Heartbeat extends the lease on a job. It returns ErrLeaseLost if the
+	// job is no longer leased to workerID.
+	Heartbeat(ctx context.Context, jobID, workerID string) error
+
+	// Complete marks the job completed and, for kinds that own the
+	// document's status, the document ready.
+	Complete(ctx context.Context, job *processor.Job, workerID string) error
+
+	// Fail marks the job failed for good with the classified err and, for
+	// kinds that own the document's status, the document as errored.
+	Fail(ctx context.Context, job *processor.Job, workerID string, err error) error
+
+	// Requeue puts the job back in the queue. With a non-nil err the attempt
+	// counts against the retry budget, err is recorded and the job is due
+	// again after delay; a job deadline that cut off a run after it made
+	// progress (processor.MadeProgress) is recorded but not counted. With a
+	// nil err the job was interrupted (e.g. by shutdown) and is released
+	// right away without counting an attempt.
+	Requeue(ctx context.Context, job *processor.Job, workerID string, err error, delay time.Duration) error
+
+	// Cancel marks a job that stopped because it was cancelled. A cancelled
+	// ingest sets its document to error, unless another ingest job for it
+	// is queued or running. If the job is gone (its document was deleted)
+	// there is nothing to mark and it returns ErrLeaseLost.
+	Cancel(ctx context.Context, job *processor.Job, workerID string) error
+
+	// CancelRequested reports whether the job should stop: cancel_requested
+	// is set, or the job no longer exists.
+	CancelRequested(ctx context.Context, jobID string) (bool, error)
+
+	// ReapExpired returns processing jobs whose lease has expired to the
+	// queue, or fails them once they have used up maxAttempts. It returns
+	// the jobs it changed.
+	ReapExpired(ctx context.Context, maxAttempts int) ([]processor.Job, error)
+
+	// Depth returns the number of queued jobs.
+	Depth(ctx context.Context) (int, error)
+}
@@ -0,0 +1,184 @@
+package queue
+
+import (
+	"context"
+	"time"
+
+	"github.com/supabase-community/supabase-go"
+	"kai-worker/processor"
+	"kai-worker/rpc"
+)
+
+// Supabase is the Queue backed by the jobs table, via PostgREST and the
+// claim_job / heartbeat_job / reap_expired_jobs functions.
+type Supabase struct {
+	client *supabase.Client
+	rpc    *rpc.Client
+	lease  time.Duration
+}
+
+// NewSupabase returns a queue that leases claimed jobs for lease at a time.
+func NewSupabase(client *supabase.Client, rpcClient *rpc.Client, lease time.Duration) *Supabase {
+	return &Supabase{client: client, rpc: rpcClient, lease: lease}
+}
+
+// Claim calls the claim_job RPC, which selects, locks and leases the next
+// job in one statement.
+func (q *Supabase) Claim(ctx context.Context, workerID string) (*processor.Job, error) {
+	var jobs []processor.Job
+	err := q.rpc.Call(ctx, "claim_job", map[string]interface{}{
+		"p_worker_id":     workerID,
+		"p_lease_seconds": int(q.lease.Seconds()),
+	}, &jobs)
+	if err != nil {
+		return nil, err
+	}
+	if len(jobs) == 0 {
+		return nil, nil
+	}
+	return &jobs[0], nil
+}
+
+// Heartbeat calls the heartbeat_job RPC, which extends the lease from the
+// database clock, the one the reaper checks it against.
+func (q *Supabase) Heartbeat(ctx context.Context, jobID, workerID string) error {
+	var renewed bool
+	err := q.rpc.Call(ctx, "heartbeat_job", map[string]interface{}{
+		"p_job_id":        jobID,
+		"p_worker_id":     workerID,
+		"p_lease_seconds": int(q.lease.Seconds()),
+	}, &renewed)
+	if err != nil {
+		return err
+	}
+	if !renewed {
+		return ErrLeaseLost
+	}
+	return nil
+}
+
+func (q *Supabase) Complete(ctx context.Context, job *processor.Job, workerID string) error {
+	// A job that succeeded on retry no longer counts as failing
+	err := q.finish(job.ID, workerID, "completed", map[string]interface{}{
+		"last_error": nil,
+		"error_code": nil,
+		"error_kind": nil,
+	})
+	if err != nil || !job.Kind.OwnsDocumentStatus() {
+		return err
+	}
+	return q.setDocumentStatus(job.DocumentID, "ready")
+}
+
+func (q *Supabase) Fail(ctx context.Context, job *processor.Job, workerID string, err error) error {
+	if err := q.finish(job.ID, workerID, "failed", failureFields(err)); err != nil || !job.Kind.OwnsDocumentStatus() {
+		return err
+	}
+	return q.setDocumentStatus(job.DocumentID, "error")
+}
+
+func (q *Supabase) Requeue(ctx context.Context, job *processor.Job, workerID string, err error, delay time.Duration) error {
+	if err == nil {
+		return q.finish(job.ID, workerID, "queued", map[string]interface{}{
+			"last_error": "interrupted by worker shutdown",
+		})
+	}
+	fields := failureFields(err)
+	if !processor.MadeProgress(err) {
+		fields["attempts"] = job.Attempts + 1
+	}
+	fields["next_attempt_at"] = time.Now().Add(delay)
+	return q.finish(job.ID, workerID, "queued", fields)
+}
+
+func (q *Supabase) Cancel(ctx context.Context, job *processor.Job, workerID string) error {
+	err := q.finish(job.ID, workerID, "cancelled", map[string]interface{}{
+		"last_error": "cancelled while processing",
+	})
+	if err != nil || !job.Kind.OwnsDocumentStatus() {
+		return err
+	}
+	return q.rpc.Call(ctx, "reset_cancelled_document", map[string]interface{}{
+		"p_document_id": job.DocumentID,
+	}, nil)
+}
+
+func (q *Supabase) CancelRequested(ctx context.Context, jobID string) (bool, error) {
+	var rows []struct {
+		CancelRequested bool `json:"cancel_requested"`
+	}
+	_, err := q.client.From("jobs").
+		Select("cancel_requested", "", false).
+		Eq("id", jobID).
+		ExecuteTo(&rows)
+	if err != nil {
+		return false, err
+	}
+	// Deleting a document cascades to its jobs
+	return len(rows) == 0 || rows[0].CancelRequested, nil
+}
+
+func (q *Supabase) ReapExpired(ctx context.Context, maxAttempts int) ([]processor.Job, error) {
+	var reaped []processor.Job
+	err := q.rpc.Call(ctx, "reap_expired_jobs", map[string]interface{}{
+		"p_max_attempts": maxAttempts,
+	}, &reaped)
+	return reaped, err
+}
+
+func (q *Supabase) Depth(ctx context.Context) (int, error) {
+	_, count, err := q.client.From("jobs").
+		Select("id", "exact", true).
+		Eq("status", "queued").
+		Execute()
+	return int(count), err
+}
+
+// finish moves a job out of processing and releases its lease. Only touch
+// the row while we still hold the lease: if we don't, nothing changes and
+// it returns ErrLeaseLost.
+func (q *Supabase) finish(jobID, workerID, status string, fields map[string]interface{}) error {
+	update := map[string]interface{}{
+		"status":           status,
+		"locked_by":        nil,
+		"lease_expires_at": nil,
+		"updated_at":       time.Now(),
+	}
+	for k, v := range fields {
+		update[k] = v
+	}
+	var released []processor.Job
+	_, err := q.client.From("jobs").
+		Update(update, "representation", "").
+		Eq("id", jobID).
+		Eq("locked_by", workerID).
+		ExecuteTo(&released)
+	if err != nil {
+		return err
+	}
+	if len(released) == 0 {
+		return ErrLeaseLost
+	}
+	return nil
+}
+
+func (q *Supabase) setDocumentStatus(documentID, status string) error {
+	if documentID == "" {
+		return nil // folder jobs have no document
+	}
+	_, _, err := q.client.From("documents").
+		Update(map[string]interface{}{"status": status}, "minimal", "").
+		Eq("id", documentID).
+		Execute()
+	return err
+}
+
+// failureFields are the jobs columns describing why a job failed.
+func failureFields(err error) map[string]interface{} {
+	perr := processor.Classify(err)
+	return map[string]interface{}{
+		"last_error": err.Error(),
+		"error_code": perr.Code,
+		"error_kind": string(perr.Kind),
+	}
+}
@@ -0,0 +1,67 @@
+// Package rpc calls Postgres functions through PostgREST. The supabase-go
+// Rpc wrapper swallows HTTP errors and poisons the shared client on failure,
+// so we talk to /rest/v1/rpc directly.
+package rpc
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+)
+
+// Client calls functions on one Supabase project with the service role key.
+type Client struct {
+	apiUrl     string
+	serviceKey string
+	http       *http.Client
+}
+
+// New returns a client whose calls give up after timeout (0 means no limit
+// beyond the caller's context).
+func New(apiUrl, serviceKey string, timeout time.Duration) *Client {
+	return &Client{
+		apiUrl:     apiUrl,
+		serviceKey: serviceKey,
+		http:       &http.Client{Timeout: timeout},
+	}
+}
+
+// Call posts params to the named function and decodes the JSON result into
+// out, which may be nil.
+func (c *Client) Call(ctx context.Context, name string, params interface{}, out interface{}) error {
+	body, err := json.Marshal(params)
+	if err != nil {
+		return err
+	}
+
+	rpcUrl := fmt.Sprintf("%s/rest/v1/rpc/%s", c.apiUrl, name)
+	req, err := http.NewRequestWithContext(ctx, "POST", rpcUrl, bytes.NewBuffer(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("apikey", c.serviceKey)
+	req.Header.Set("Authorization", "Bearer "+c.serviceKey)
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return fmt.Errorf("rpc %s failed: %w", name, err)
+	}
+	defer resp.Body.Close()
+
+	raw, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("rpc %s error %d: %s", name, resp.StatusCode, string(raw))
+	}
+	if out == nil || len(raw) == 0 {
+		return nil
+	}
+	return json.Unmarshal(raw, out)
+}
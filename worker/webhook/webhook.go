@@ -0,0 +1,307 @@
+// Package webhook delivers signed document.* events to configured endpoints.
+//
+// Each event is stored in webhook_deliveries, one row per endpoint, and then
+// POSTed as JSON by a background loop that retries failures with backoff.
+// Every request carries:
+//
+//	X-Kai-Event:     the event type, e.g. document.ready
+//	X-Kai-Delivery:  the delivery ID (stable across retries)
+//	X-Kai-Signature: t=<unix seconds>,v1=<hex HMAC-SHA256 of "<t>.<body>">
+//
+// Receivers should recompute v1 with the shared secret, compare in constant
+// time and reject stale timestamps. Deliveries are at-least-once; use the
+// event "id" to drop duplicates.
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/supabase-community/supabase-go"
+	"kai-worker/config"
+	"kai-worker/processor"
+	"kai-worker/rpc"
+)
+
+// Event types.
+const (
+	DocumentProcessing = "document.processing"
+	DocumentReady      = "document.ready"
+	DocumentFailed     = "document.failed"
+)
+
+const (
+	// pollInterval is how often due retries are looked for when idle.
+	pollInterval = 10 * time.Second
+	// claimBatch is how many deliveries are claimed at once.
+	claimBatch = 20
+	// claimLease keeps other workers off a claimed delivery while it is sent.
+	claimLease = time.Minute
+	// Failed deliveries are retried after retryBaseDelay * 2^(attempts-1),
+	// capped at retryMaxDelay.
+	retryBaseDelay = 30 * time.Second
+	retryMaxDelay  = time.Hour
+)
+
+// Event is the JSON body POSTed to endpoints.
+type Event struct {
+	ID        string    `json:"id"`
+	Type      string    `json:"type"`
+	CreatedAt time.Time `json:"created_at"`
+	Data      EventData `json:"data"`
+}
+
+type EventData struct {
+	DocumentID   string `json:"document_id"`
+	DocumentName string `json:"document_name,omitempty"`
+	UserID       string `json:"user_id,omitempty"`
+	JobID        string `json:"job_id,omitempty"`
+	JobKind      string `json:"job_kind,omitempty"`
+	Attempt      int    `json:"attempt"`
+	PagesTotal   *int   `json:"pages_total"`
+	PagesDone    *int   `json:"pages_done"`
+	ErrorCode    string `json:"error_code,omitempty"`
+	ErrorKind    string `json:"error_kind,omitempty"`
+	Error        string `json:"error,omitempty"`
+}
+
+// Dispatcher records and delivers events. A Dispatcher with no endpoints
+// does nothing.
+type Dispatcher struct {
+	client *supabase.Client
+	rpc    *rpc.Client
+	http   *http.Client
+	cfg    config.Webhooks
+	wake   chan struct{}
+}
+
+func NewDispatcher(client *supabase.Client, rpcClient *rpc.Client, cfg config.Webhooks) *Dispatcher {
+	return &Dispatcher{
+		client: client,
+		rpc:    rpcClient,
+		http:   &http.Client{Timeout: cfg.Timeout},
+		cfg:    cfg,
+		wake:   make(chan struct{}, 1),
+	}
+}
+
+// Enabled reports whether any endpoints are configured.
+func (d *Dispatcher) Enabled() bool {
+	return d != nil && len(d.cfg.URLs) > 0
+}
+
+// Emit records an event about job's document for every endpoint. failure is
+// the job's error for document.failed, nil otherwise. Problems are logged,
+// never returned: a webhook must not fail the job it reports on.
+func (d *Dispatcher) Emit(ctx context.Context, eventType string, job *processor.Job, failure error) {
+	if !d.Enabled() || job.DocumentID == "" {
+		return // folder jobs report through their children
+	}
+
+	data := EventData{
+		DocumentID: job.DocumentID,
+		UserID:     job.UserID,
+		JobID:      job.ID,
+		JobKind:    string(job.Kind),
+		Attempt:    job.Attempts + 1,
+	}
+	if failure != nil {
+		perr := processor.Classify(failure)
+		data.ErrorCode = perr.Code
+		data.ErrorKind = string(perr.Kind)
+		data.Error = failure.Error()
+	}
+
+	var docs []struct {
+		Name       string `json:"name"`
+		PagesTotal *int   `json:"pages_total"`
+		PagesDone  *int   `json:"pages_done"`
+	}
+	_, err := d.client.From("documents").
+		Select("name, pages_total, pages_done", "", false).
+		Eq("id", job.DocumentID).
+		ExecuteTo(&docs)
+	if err != nil {
+		slog.WarnContext(ctx, "Failed to load document for webhook", "event", eventType, "error", err)
+	} else if len(docs) > 0 {
+		data.DocumentName = docs[0].Name
+		data.PagesTotal = docs[0].PagesTotal
+		data.PagesDone = docs[0].PagesDone
+	}
+
+	event := Event{
+		ID:        uuid.NewString(),
+		Type:      eventType,
+		CreatedAt: time.Now().UTC(),
+		Data:      data,
+	}
+	payload, err := json.Marshal(event)
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to encode webhook event", "event", eventType, "error", err)
+		return
+	}
+
+	rows := make([]map[string]interface{}, len(d.cfg.URLs))
+	for i, endpoint := range d.cfg.URLs {
+		rows[i] = map[string]interface{}{
+			"event_id":    event.ID,
+			"event_type":  eventType,
+			"document_id": job.DocumentID,
+			"endpoint":    endpoint,
+			"payload":     json.RawMessage(payload),
+		}
+	}
+	_, _, err = d.client.From("webhook_deliveries").Insert(rows, false, "", "minimal", "").Execute()
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to record webhook event", "event", eventType, "error", err)
+		return
+	}
+
+	// Deliver now rather than at the next poll
+	select {
+	case d.wake <- struct{}{}:
+	default:
+	}
+}
+
+type delivery struct {
+	ID        string          `json:"id"`
+	EventType string          `json:"event_type"`
+	Endpoint  string          `json:"endpoint"`
+	Payload   json.RawMessage `json:"payload"`
+	Attempts  int             `json:"attempts"`
+}
+
+// Run delivers pending events until ctx is cancelled.
+func (d *Dispatcher) Run(ctx context.Context) {
+	if !d.Enabled() {
+		return
+	}
+
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+	for {
+		var due []delivery
+		err := d.rpc.Call(ctx, "claim_webhook_deliveries", map[string]interface{}{
+			"p_limit":         claimBatch,
+			"p_lease_seconds": int(claimLease.Seconds()),
+		}, &due)
+		if err != nil && ctx.Err() == nil {
+			slog.WarnContext(ctx, "Failed to claim webhook deliveries", "error", err)
+		}
+		for _, dl := range due {
+			d.deliver(ctx, dl)
+		}
+		if len(due) == claimBatch {
+			continue // more may be waiting
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-d.wake:
+		case <-ticker.C:
+		}
+	}
+}
+
+// deliver sends one delivery and records the outcome.
+func (d *Dispatcher) deliver(ctx context.Context, dl delivery) {
+	status, err := d.send(ctx, dl)
+	if err == nil {
+		d.update(ctx, dl, map[string]interface{}{
+			"status":           "delivered",
+			"last_status_code": status,
+			"last_error":       nil,
+			"delivered_at":     time.Now(),
+		})
+		return
+	}
+
+	update := map[string]interface{}{
+		"last_error": err.Error(),
+	}
+	if status != 0 {
+		update["last_status_code"] = status
+	}
+	if dl.Attempts >= d.cfg.MaxAttempts {
+		update["status"] = "failed"
+		slog.WarnContext(ctx, "Webhook delivery failed for good", "delivery_id", dl.ID,
+			"event", dl.EventType, "endpoint", dl.Endpoint, "attempts", dl.Attempts, "error", err)
+	} else {
+		update["next_attempt_at"] = time.Now().Add(retryDelay(dl.Attempts))
+		slog.InfoContext(ctx, "Webhook delivery failed; will retry", "delivery_id", dl.ID,
+			"event", dl.EventType, "endpoint", dl.Endpoint, "attempts", dl.Attempts, "error", err)
+	}
+	d.update(ctx, dl, update)
+}
+
+// send POSTs the signed payload. It returns the HTTP status, if any, and an
+// error unless the endpoint answered 2xx.
+func (d *Dispatcher) send(ctx context.Context, dl delivery) (int, error) {
+	req, err := http.NewRequestWithContext(ctx, "POST", dl.Endpoint, bytes.NewReader(dl.Payload))
+	if err != nil {
+		return 0, err
+	}
+	ts := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "kai-worker")
+	req.Header.Set("X-Kai-Event", dl.EventType)
+	req.Header.Set("X-Kai-Delivery", dl.ID)
+	req.Header.Set("X-Kai-Signature", "t="+ts+",v1="+Sign(d.cfg.Secret, ts, dl.Payload))
+
+	resp, err := d.http.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return resp.StatusCode, fmt.Errorf("endpoint returned %d: %s", resp.StatusCode, bytes.TrimSpace(body))
+	}
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	return resp.StatusCode, nil
+}
+
+func (d *Dispatcher) update(ctx context.Context, dl delivery, fields map[string]interface{}) {
+	_, _, err := d.client.From("webhook_deliveries").
+		Update(fields, "minimal", "").
+		Eq("id", dl.ID).
+		Execute()
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to record webhook delivery", "delivery_id", dl.ID, "error", err)
+	}
+}
+
+// Sign returns the hex HMAC-SHA256 of "<timestamp>.<body>" under secret, as
+// sent in the v1 part of X-Kai-Signature.
+func Sign(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// retryDelay is the backoff after the given number of failed attempts.
+func retryDelay(attempts int) time.Duration {
+	if attempts < 1 {
+		attempts = 1
+	}
+	if attempts > 8 {
+		return retryMaxDelay
+	}
+	return min(retryBaseDelay<<(attempts-1), retryMaxDelay)
+}